@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// useCallAttributes makes calls also store their payload in call_attributes,
+// one row per key, and makes key and value filters and group-bys use it.
+var useCallAttributes bool
+
+// callAttributesSQL selects the attributes of calls. Values are taken as
+// ->> returns them, so that filtering on them gives the same result as
+// filtering on the payload.
+const callAttributesSQL = `
+INSERT INTO call_attributes (call_id, key, value_text, value_num)
+SELECT c.id, k.key, c.payload ->> k.key, CASE WHEN jsonb_typeof(k.value) = 'number' THEN (k.value #>> '{}')::numeric END
+FROM calls c, jsonb_each(c.payload) AS k(key, value)
+WHERE `
+
+// storeCalls inserts calls and their attributes in a single transaction.
+func storeCalls(calls []Call) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(&calls, 500).Error; err != nil {
+			return err
+		}
+		if !useCallAttributes {
+			return nil
+		}
+
+		ids := make([]uint, len(calls))
+		for i, c := range calls {
+			ids[i] = c.ID
+		}
+		return tx.Exec(callAttributesSQL+"c.id IN ?", ids).Error
+	})
+}
+
+// backfillCallAttributes adds the attributes of the calls that were stored
+// before call attributes were used, in batches of batch calls.
+func backfillCallAttributes(batch int) (int64, error) {
+	var total int64
+	for {
+		res := db.Exec(callAttributesSQL+`c.id IN (
+			SELECT id FROM calls
+			WHERE jsonb_typeof(payload) = 'object' AND payload <> '{}'
+				AND NOT EXISTS (SELECT 1 FROM call_attributes a WHERE a.call_id = calls.id)
+			LIMIT ?)`, batch)
+		if res.Error != nil {
+			return total, res.Error
+		}
+
+		total += res.RowsAffected
+		log.Debug().Msgf("backfilled %d call attributes", res.RowsAffected)
+		if res.RowsAffected == 0 {
+			return total, nil
+		}
+	}
+}
+
+// deleteCallAttributes deletes the attributes of the calls with the given
+// ids. They are deleted even when call attributes are not used, as they might
+// have been before.
+func deleteCallAttributes(tx *gorm.DB, ids []uint) error {
+	return tx.Where("call_id IN ?", ids).Delete(&CallAttribute{}).Error
+}
+
+// hasKeyFilter limits a calls query to the calls with key in their payload.
+func hasKeyFilter(gq *gorm.DB, key string) *gorm.DB {
+	if useCallAttributes {
+		return gq.Where("EXISTS (SELECT 1 FROM call_attributes a WHERE a.call_id = calls.id AND a.key = ?)", key)
+	}
+	return gq.Where(datatypes.JSONQuery("payload").HasKey(key))
+}
+
+// payloadFilter limits a calls query to the calls that match pf.
+func payloadFilter(gq *gorm.DB, pf PayloadFilter, num float64) *gorm.DB {
+	if useCallAttributes {
+		switch pf.Op {
+		case "eq":
+			return gq.Where("EXISTS (SELECT 1 FROM call_attributes a WHERE a.call_id = calls.id AND a.key = ? AND a.value_text = ?)", pf.Key, pf.Value)
+		case "ne":
+			return gq.Where("NOT EXISTS (SELECT 1 FROM call_attributes a WHERE a.call_id = calls.id AND a.key = ? AND a.value_text = ?)", pf.Key, pf.Value)
+		default:
+			return gq.Where(fmt.Sprintf("EXISTS (SELECT 1 FROM call_attributes a WHERE a.call_id = calls.id AND a.key = ? AND a.value_num %s ?)",
+				payloadFilterOps[pf.Op]), pf.Key, num)
+		}
+	}
+
+	switch pf.Op {
+	case "eq":
+		return gq.Where("payload ->> ? = ?", pf.Key, pf.Value)
+	case "ne":
+		return gq.Where("payload ->> ? IS DISTINCT FROM ?", pf.Key, pf.Value)
+	default:
+		// only compare numbers, other values never match
+		return gq.Where(fmt.Sprintf("(CASE WHEN jsonb_typeof(payload -> ?) = 'number' THEN (payload ->> ?)::numeric END) %s ?",
+			payloadFilterOps[pf.Op]), pf.Key, pf.Key, num)
+	}
+}
+
+// groupByValue limits a calls query to the calls with key in their payload
+// and returns the expression of its value, empty for null.
+func groupByValue(gq *gorm.DB, key string) (*gorm.DB, string, []interface{}) {
+	if useCallAttributes {
+		gq = gq.Joins("JOIN call_attributes g ON g.call_id = calls.id AND g.key = ?", key)
+		return gq, "coalesce(g.value_text, '')", nil
+	}
+	return hasKeyFilter(gq, key), "coalesce(payload ->> ?, '')", []interface{}{key}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	batchAccepted = "accepted"
+	batchStripped = "stripped"
+	batchRejected = "rejected"
+)
+
+// splitBatch splits a batch body, either a JSON array or newline delimited
+// JSON, into its items. Blank NDJSON lines are skipped.
+func splitBatch(body []byte) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return items, nil
+	}
+
+	if trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %s", err)
+		}
+		return items, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 64*1024), len(trimmed)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, json.RawMessage(append([]byte{}, line...)))
+	}
+
+	return items, scanner.Err()
+}
+
+// registerBatch validates every item like a single call and inserts the valid
+// ones in a single transaction. Results are in the order of the items.
+func registerBatch(items []json.RawMessage, base Call) ([]BatchResult, error) {
+	results, calls := prepareBatch(items, base)
+	if len(calls) == 0 {
+		return results, nil
+	}
+
+	return results, store.RegisterCalls(calls)
+}
+
+// prepareBatch validates every item like a single call and returns the
+// results, in the order of the items, and the calls to store.
+func prepareBatch(items []json.RawMessage, base Call) ([]BatchResult, []Call) {
+	results := make([]BatchResult, len(items))
+	calls := []Call{}
+
+	for i, item := range items {
+		results[i].Index = i
+
+		call := base
+		call.Payload.RawMessage = item
+
+		cr, err := prepareCall(&call)
+		if err != nil {
+			results[i].Status = batchRejected
+			results[i].Error = err.Error()
+			continue
+		}
+
+		results[i].Payload, err = json.Marshal(cr.payload)
+		if err != nil {
+			results[i].Status = batchRejected
+			results[i].Error = err.Error()
+			continue
+		}
+
+		results[i].Status = batchAccepted
+		results[i].Redactions = cr.redactions
+		if len(cr.stripped) > 0 {
+			results[i].Status = batchStripped
+			results[i].Stripped = cr.stripped
+		}
+		calls = append(calls, call)
+	}
+
+	return results, calls
+}
+
+// @Summary      Register a batch of telemetry calls.
+// @Description  Register many calls at once, e.g. when flushing calls that were buffered while offline.
+// @Description
+// @Description  Takes either a JSON array of payloads or newline delimited JSON with one payload per line.
+// @Description  Every payload is validated like a single call and gets its own result: `accepted`, `stripped` or `rejected`.
+// @Description  A payload can hold the time the call happened in `_ts`, as RFC 3339 or unix seconds.
+// @Description  The `X-Phonehome-Timestamp` header sets it for payloads without one.
+// @Description  All accepted calls are registered in a single transaction, or all queued when the server stores calls in the background.
+// @Description  Every call of a batch counts against the rate limits, so a batch can't hold more calls than their burst.
+// @Accept       json
+// @Accept       x-ndjson
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Param        event         path   string  true   "event name of all calls in the batch"
+// @Produce      json
+// @Success      200  {object}  BatchResp
+// @Failure      413  {object}  BatchResp
+// @Failure      429  {object}  BatchResp
+// @Failure      503  {object}  BatchResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/batch [post]
+// @Router       /{organisation}/{repository}/e/{event}/batch [post]
+func registerBatchHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var resp BatchResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	body, err := readBody(c, payloadLimits.MaxBatchBytes)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(bodyErrorStatus(err), resp)
+		return
+	}
+
+	items, err := splitBatch(body)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if max := payloadLimits.MaxBatchItems; max > 0 && len(items) > max {
+		resp.Error = fmt.Sprintf("batch holds %d calls, the maximum is %d", len(items), max)
+		c.JSON(http.StatusRequestEntityTooLarge, resp)
+		return
+	}
+
+	if max := rateLimitsFor(or.Organisation, or.Repository).maxCalls(); max > 0 && len(items) > max {
+		resp.Error = fmt.Sprintf("batch holds %d calls, the rate limit allows %d at once", len(items), max)
+		c.JSON(http.StatusRequestEntityTooLarge, resp)
+		return
+	}
+
+	origin, err := callOrigin(c)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	// the rate limit middlewares took a token for the first call
+	if len(items) > 1 {
+		if ok, retryAfter := allowCalls(or.Organisation, or.Repository, origin, len(items)-1); !ok {
+			droppedCalls.add(or.Organisation, or.Repository, dropReasonRateLimited, "", int64(len(items)))
+
+			setRetryAfter(c, retryAfter)
+			resp.Error = fmt.Sprintf("rate limit exceeded for %s/%s", or.Organisation, or.Repository)
+			c.JSON(http.StatusTooManyRequests, resp)
+			return
+		}
+	}
+
+	base := Call{Organisation: or.Organisation, Repository: or.Repository, Event: c.Param("event"), Origin: origin}
+	if h := c.GetHeader(clientTimestampHeader); h != "" {
+		ts, err := parseClientTimestampHeader(h)
+		if err != nil {
+			resp.Error = err.Error()
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
+		base.ClientTimestamp = &ts
+	}
+
+	results, err := registerBatch(items, base)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(ingestErrorStatus(c, err, http.StatusInternalServerError), resp)
+		return
+	}
+
+	for _, r := range results {
+		if r.Status == batchRejected {
+			resp.Rejected++
+		} else {
+			resp.Accepted++
+		}
+	}
+	resp.Results = results
+
+	c.JSON(200, resp)
+}
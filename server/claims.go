@@ -0,0 +1,614 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	claimFile = ".phonehome"
+
+	scopeAdmin = "admin"
+	scopeWrite = "write"
+	scopeRead  = "read"
+	// scopeBadge is only used to enforce tokens on the badge endpoint, which
+	// private repositories can keep public. It is covered by read tokens.
+	scopeBadge = "badge"
+
+	visibilityPublic  = "public"
+	visibilityPrivate = "private"
+)
+
+var (
+	errAlreadyClaimed   = errors.New("repository has already been claimed")
+	errNoClaim          = errors.New("no claim in progress, start one first")
+	errClaimNotVerified = errors.New("claim could not be verified")
+	errLastAdminToken   = errors.New("can't revoke the last admin token")
+
+	// writeTokenCache caches whether a repository has write tokens, which
+	// every call needs to know
+	writeTokenCache = newRepoCache(30 * time.Second)
+)
+
+func newToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// scopeAllows reports whether a token of scope has access to required.
+// Admin tokens can do everything, write and read tokens only what they say.
+func scopeAllows(scope string, required string) bool {
+	return scope == scopeAdmin || scope == required || (scope == scopeRead && required == scopeBadge)
+}
+
+func getRepository(org string, repo string) (Repository, error) {
+	var r Repository
+	err := db.Where("organisation = ? AND repository = ?", org, repo).First(&r).Error
+	return r, err
+}
+
+// claimRepository starts a claim by handing out the token that has to be
+// committed to the repository. Claiming again before verification hands out
+// the same token, so that nobody can keep replacing the token of a claim in
+// progress.
+func claimRepository(org string, repo string) (string, error) {
+	r, err := getRepository(org, repo)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
+	}
+	if r.ClaimedAt != nil {
+		return "", errAlreadyClaimed
+	}
+	if r.ClaimToken != "" {
+		return r.ClaimToken, nil
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	// a concurrent claim might have set a token meanwhile, only fill in a missing one
+	r = Repository{Organisation: org, Repository: repo, ClaimToken: token}
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organisation"}, {Name: "repository"}},
+		DoUpdates: clause.AssignmentColumns([]string{"claim_token"}),
+		Where: clause.Where{Exprs: []clause.Expression{clause.Expr{
+			SQL: "repositories.claimed_at IS NULL AND (repositories.claim_token IS NULL OR repositories.claim_token = '')",
+		}}},
+	}).Create(&r).Error
+	if err != nil {
+		return "", err
+	}
+
+	r, err = getRepository(org, repo)
+	if err != nil {
+		return "", err
+	}
+	if r.ClaimedAt != nil {
+		return "", errAlreadyClaimed
+	}
+	return r.ClaimToken, nil
+}
+
+// verifyClaim checks that the claim token was committed to the repository and
+// if so marks it as claimed and returns its first admin token.
+func verifyClaim(org string, repo string) (string, error) {
+	r, err := getRepository(org, repo)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", errNoClaim
+	}
+	if err != nil {
+		return "", err
+	}
+	if r.ClaimedAt != nil {
+		return "", errAlreadyClaimed
+	}
+	if r.ClaimToken == "" {
+		return "", errNoClaim
+	}
+
+	content, err := githubFileContent(org, repo, claimFile)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errClaimNotVerified, err)
+	}
+	if strings.TrimSpace(content) != r.ClaimToken {
+		return "", fmt.Errorf("%w: %s in %s/%s doesn't contain the claim token", errClaimNotVerified, claimFile, org, repo)
+	}
+
+	var token string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// guard against concurrent verifications both handing out an admin token
+		res := tx.Model(&Repository{}).
+			Where("organisation = ? AND repository = ? AND claimed_at IS NULL", org, repo).
+			Updates(map[string]interface{}{"claimed_at": time.Now(), "claim_token": ""})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected != 1 {
+			return errAlreadyClaimed
+		}
+
+		token, _, err = createRepoToken(tx, org, repo, scopeAdmin, "claim")
+		return err
+	})
+
+	return token, err
+}
+
+func createRepoToken(tx *gorm.DB, org string, repo string, scope string, description string) (string, RepoToken, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", RepoToken{}, err
+	}
+
+	rt := RepoToken{
+		Organisation: org,
+		Repository:   repo,
+		Scope:        scope,
+		Hash:         hashToken(token),
+		Description:  description,
+	}
+	if err := tx.Create(&rt).Error; err != nil {
+		return "", rt, err
+	}
+
+	return token, rt, nil
+}
+
+func getRepoTokens(org string, repo string) ([]RepoToken, error) {
+	rts := []RepoToken{}
+	err := db.Where("organisation = ? AND repository = ?", org, repo).Order("id asc").Find(&rts).Error
+	return rts, err
+}
+
+func deleteRepoToken(org string, repo string, id uint) (bool, error) {
+	var deleted bool
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("organisation = ? AND repository = ? AND id = ?", org, repo, id).Delete(&RepoToken{})
+		if res.Error != nil {
+			return res.Error
+		}
+		deleted = res.RowsAffected > 0
+
+		// the repository can't be claimed again, so keep maintainers from locking themselves out
+		var admins int64
+		if err := tx.Model(&RepoToken{}).
+			Where("organisation = ? AND repository = ? AND scope = ?", org, repo, scopeAdmin).
+			Count(&admins).Error; err != nil {
+			return err
+		}
+		if admins == 0 {
+			return errLastAdminToken
+		}
+
+		return nil
+	})
+
+	return deleted, err
+}
+
+// tokenRequired reports whether requests of scope need a token. Admin
+// endpoints always do, writes once a write token has been issued for the
+// repository and reads when the repository is private.
+func tokenRequired(org string, repo string, scope string) (bool, error) {
+	switch scope {
+	case scopeAdmin:
+		return true, nil
+	case scopeWrite:
+		v, err := writeTokenCache.get(org, repo, func() (interface{}, error) {
+			var count int64
+			err := db.Model(&RepoToken{}).
+				Where("organisation = ? AND repository = ? AND scope = ?", org, repo, scope).
+				Count(&count).Error
+			return count > 0, err
+		})
+		if err != nil {
+			return false, err
+		}
+		return v.(bool), nil
+	default:
+		r, err := getRepository(org, repo)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if r.ClaimedAt == nil || r.Visibility != visibilityPrivate {
+			return false, nil
+		}
+		return scope == scopeRead || !r.PublicBadge, nil
+	}
+}
+
+func validRepoToken(org string, repo string, token string, scope string) (bool, error) {
+	return validRepoTokenHash(org, repo, hashToken(token), scope)
+}
+
+func validRepoTokenHash(org string, repo string, hash string, scope string) (bool, error) {
+	var rt RepoToken
+	err := db.Where("organisation = ? AND repository = ? AND hash = ?", org, repo, hash).First(&rt).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return scopeAllows(rt.Scope, scope), nil
+}
+
+func bearerToken(c *gin.Context) string {
+	h := c.GetHeader("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// repoTokenMW enforces the tokens of a claimed repository, see tokenRequired.
+func repoTokenMW(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		org := c.Param("organisation")
+		repo := c.Param("repository")
+
+		required, err := tokenRequired(org, repo, scope)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, DefaultResp{Error: err.Error()})
+			return
+		}
+		if !required {
+			c.Next()
+			return
+		}
+
+		token := bearerToken(c)
+		if token == "" {
+			needed := scope
+			if scope == scopeBadge {
+				needed = scopeRead
+			}
+			resp := DefaultResp{Error: fmt.Sprintf("%s/%s requires a %s token", org, repo, needed)}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, resp)
+			return
+		}
+
+		ok, err := validRepoToken(org, repo, token, scope)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, DefaultResp{Error: err.Error()})
+			return
+		}
+		if !ok {
+			resp := DefaultResp{Error: fmt.Sprintf("token is not valid for %s access to %s/%s", scope, org, repo)}
+			c.AbortWithStatusJSON(http.StatusForbidden, resp)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// @Summary      Start claiming a repository.
+// @Description  Start proving ownership of a repository. Commit the returned token as the only content
+// @Description  of a `.phonehome` file to the default branch of the repository and call `/claim/verify`.
+// @Description  Claiming again before the claim is verified returns the same token.
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Produce      json
+// @Success      200  {object}  ClaimResp
+// @Router       /{organisation}/{repository}/claim [post]
+func claimHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var resp ClaimResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	token, err := claimRepository(or.Organisation, or.Repository)
+	if errors.Is(err, errAlreadyClaimed) {
+		resp.Error = err.Error()
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Token = token
+	resp.Message = fmt.Sprintf("commit a %s file containing the token to %s/%s and call the verify endpoint",
+		claimFile, or.Organisation, or.Repository)
+	c.JSON(200, resp)
+}
+
+// @Summary      Verify a repository claim.
+// @Description  Checks that the `.phonehome` file of the repository contains the claim token.
+// @Description  On success the repository is claimed and an admin token is returned. It is only shown once.
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Produce      json
+// @Success      200  {object}  ClaimResp
+// @Router       /{organisation}/{repository}/claim/verify [post]
+func verifyClaimHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var resp ClaimResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	token, err := verifyClaim(or.Organisation, or.Repository)
+	if err != nil {
+		resp.Error = err.Error()
+		switch {
+		case errors.Is(err, errAlreadyClaimed):
+			c.JSON(http.StatusConflict, resp)
+		case errors.Is(err, errNoClaim):
+			c.JSON(http.StatusBadRequest, resp)
+		case errors.Is(err, errClaimNotVerified):
+			c.JSON(http.StatusForbidden, resp)
+		default:
+			c.JSON(http.StatusInternalServerError, resp)
+		}
+		return
+	}
+
+	resp.Token = token
+	resp.Message = "repository claimed, keep this admin token safe as it can't be shown again"
+	c.JSON(200, resp)
+}
+
+// @Summary      Issue a repository token.
+// @Description  Issue a `read`, `write` or `admin` token for a claimed repository. Once a write token exists,
+// @Description  registering calls needs a write token. Private repositories need a read token for all GET endpoints.
+// @Description  Pass tokens as `Authorization: Bearer <token>`. Requires an admin token.
+// @Accept       json
+// @Param        organisation  path   string           true  "github organisation"
+// @Param        repository    path   string           true  "repository name"
+// @Param        token         body   TokenRequest     true  "token to issue"
+// @Produce      json
+// @Success      200  {object}  TokenResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/tokens [post]
+func createTokenHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var req TokenRequest
+	var resp TokenResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if req.Scope != scopeRead && req.Scope != scopeWrite && req.Scope != scopeAdmin {
+		resp.Error = fmt.Sprintf("unknown scope '%s', expected read, write or admin", req.Scope)
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	token, rt, err := createRepoToken(db, or.Organisation, or.Repository, req.Scope, req.Description)
+	writeTokenCache.forget(or.Organisation, or.Repository)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Token = token
+	resp.Data = &rt
+	c.JSON(200, resp)
+}
+
+// @Summary      List repository tokens.
+// @Description  List the tokens of a claimed repository, without the secrets. Requires an admin token.
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Produce      json
+// @Success      200  {object}  TokensResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/tokens [get]
+func getTokensHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var resp TokensResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	rts, err := getRepoTokens(or.Organisation, or.Repository)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Data = rts
+	c.JSON(200, resp)
+}
+
+// @Summary      Revoke a repository token.
+// @Description  Revoke a token of a claimed repository. Requires an admin token.
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Param        id            path   int     true   "token id"
+// @Produce      json
+// @Success      200  {object}  DefaultResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/tokens/{id} [delete]
+func deleteTokenHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var resp DefaultResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid token id '%s'", c.Param("id"))
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	deleted, err := deleteRepoToken(or.Organisation, or.Repository, uint(id))
+	writeTokenCache.forget(or.Organisation, or.Repository)
+	if errors.Is(err, errLastAdminToken) {
+		resp.Error = err.Error()
+		c.JSON(http.StatusConflict, resp)
+		return
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	if !deleted {
+		resp.Error = fmt.Sprintf("token %d not found", id)
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+
+	c.JSON(200, resp)
+}
+
+func updateRepositorySettings(org string, repo string, rs RepositorySettings) (Repository, error) {
+	updates := map[string]interface{}{}
+
+	if rs.Visibility != nil {
+		if *rs.Visibility != visibilityPublic && *rs.Visibility != visibilityPrivate {
+			return Repository{}, fmt.Errorf("unknown visibility '%s', expected public or private", *rs.Visibility)
+		}
+		updates["visibility"] = *rs.Visibility
+	}
+	if rs.PublicBadge != nil {
+		updates["public_badge"] = *rs.PublicBadge
+	}
+	if rs.RetentionDays != nil {
+		if *rs.RetentionDays < 0 {
+			return Repository{}, fmt.Errorf("retention_days can't be negative")
+		}
+		updates["retention_days"] = *rs.RetentionDays
+	}
+	if rs.RollupExpired != nil {
+		updates["rollup_expired"] = *rs.RollupExpired
+	}
+
+	if len(updates) > 0 {
+		err := db.Model(&Repository{}).Where("organisation = ? AND repository = ?", org, repo).Updates(updates).Error
+		if err != nil {
+			return Repository{}, err
+		}
+		retentionCache.forget(org, repo)
+	}
+
+	return getRepository(org, repo)
+}
+
+// @Summary      Get repository settings.
+// @Description  Get the settings of a claimed repository. Requires an admin token.
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Produce      json
+// @Success      200  {object}  RepositoryResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/settings [get]
+func getSettingsHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var resp RepositoryResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	r, err := getRepository(or.Organisation, or.Repository)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Data = &r
+	c.JSON(200, resp)
+}
+
+// @Summary      Update repository settings.
+// @Description  Update the settings of a claimed repository, fields that are left out are not changed.
+// @Description  `visibility` is `public` (default) or `private`. Private repositories need a read token for all GET endpoints,
+// @Description  except for the badge when `public_badge` is set.
+// @Description  `retention_days` is how many days raw calls are kept, 0 keeps them forever. Unless `rollup_expired` is false
+// @Description  expired calls keep being counted per day, without filters on payload values. Requires an admin token.
+// @Accept       json
+// @Param        organisation  path   string              true  "github organisation"
+// @Param        repository    path   string              true  "repository name"
+// @Param        settings      body   RepositorySettings  true  "settings to change"
+// @Produce      json
+// @Success      200  {object}  RepositoryResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/settings [patch]
+func updateSettingsHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var rs RepositorySettings
+	var resp RepositoryResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.ShouldBindJSON(&rs); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	r, err := updateRepositorySettings(or.Organisation, or.Repository, rs)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	resp.Data = &r
+	c.JSON(200, resp)
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const analyticsSinkClickHouse = "clickhouse"
+
+// analyticsSink copies calls to ClickHouse, nil when ANALYTICS_SINK isn't set
+var analyticsSink *clickHouseSink
+
+// clickHouseTableSQL creates the table the calls are copied to. Payloads are
+// kept as JSON text, the JSON functions read them about as fast as columns
+// for the flat payloads calls have.
+const clickHouseTableSQL = `CREATE TABLE IF NOT EXISTS calls (
+	organisation String,
+	repository String,
+	event LowCardinality(String),
+	origin String,
+	timestamp DateTime64(6, 'UTC'),
+	client_timestamp Nullable(DateTime64(6, 'UTC')),
+	payload String
+)
+ENGINE = MergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (organisation, repository, timestamp)`
+
+// clickHouseTimeLayout is how DateTime64 values are written and read.
+const clickHouseTimeLayout = "2006-01-02 15:04:05.999999"
+
+// clickHouse is a ClickHouse server, spoken to over its HTTP interface.
+type clickHouse struct {
+	url      string
+	database string
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newClickHouse() *clickHouse {
+	return &clickHouse{
+		url:      strings.TrimSuffix(viper.GetString("CLICKHOUSE_URL"), "/"),
+		database: viper.GetString("CLICKHOUSE_DATABASE"),
+		user:     viper.GetString("CLICKHOUSE_USER"),
+		password: viper.GetString("CLICKHOUSE_PASSWORD"),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// exec runs query with the given query parameters, which it refers to as
+// {name:Type}, and sends body after it, as the data of an INSERT.
+func (ch *clickHouse) exec(query string, params map[string]string, body []byte) (io.ReadCloser, error) {
+	q := url.Values{}
+	q.Set("database", ch.database)
+	q.Set("output_format_json_quote_64bit_integers", "0")
+	for k, v := range params {
+		q.Set("param_"+k, v)
+	}
+
+	var data io.Reader = strings.NewReader(query)
+	if body != nil {
+		q.Set("query", query)
+		data = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest("POST", ch.url+"/?"+q.Encode(), data)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-ClickHouse-User", ch.user)
+	req.Header.Set("X-ClickHouse-Key", ch.password)
+
+	resp, err := ch.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("clickhouse: %s", strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+// query runs a SELECT and decodes each row into a value returned by next.
+func (ch *clickHouse) query(query string, params map[string]string, next func() interface{}) error {
+	body, err := ch.exec(query+" FORMAT JSONEachRow", params, nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(body))
+	for dec.More() {
+		if err := dec.Decode(next()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clickHouseRow is a call as it is inserted in ClickHouse.
+type clickHouseRow struct {
+	Organisation    string  `json:"organisation"`
+	Repository      string  `json:"repository"`
+	Event           string  `json:"event"`
+	Origin          string  `json:"origin"`
+	Timestamp       string  `json:"timestamp"`
+	ClientTimestamp *string `json:"client_timestamp"`
+	Payload         string  `json:"payload"`
+}
+
+func newClickHouseRow(c Call) clickHouseRow {
+	row := clickHouseRow{
+		Organisation: c.Organisation,
+		Repository:   c.Repository,
+		Event:        c.Event,
+		Origin:       c.Origin,
+		Timestamp:    c.Timestamp.UTC().Format(clickHouseTimeLayout),
+		Payload:      string(c.Payload.RawMessage),
+	}
+	if c.ClientTimestamp != nil {
+		ts := c.ClientTimestamp.UTC().Format(clickHouseTimeLayout)
+		row.ClientTimestamp = &ts
+	}
+	if row.Payload == "" {
+		row.Payload = "{}"
+	}
+	return row
+}
+
+func (ch *clickHouse) createTable() error {
+	body, err := ch.exec(clickHouseTableSQL, nil, nil)
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+func (ch *clickHouse) insert(rows []clickHouseRow) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range rows {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	body, err := ch.exec("INSERT INTO calls FORMAT JSONEachRow", nil, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return body.Close()
+}
+
+// clickHouseSink copies calls to ClickHouse in the background. Calls are
+// buffered and inserted every CLICKHOUSE_FLUSH_INTERVAL or once there are
+// CLICKHOUSE_FLUSH_ROWS of them, as ClickHouse prefers few large inserts.
+// Inserts that fail are retried with the next flush, until more than
+// CLICKHOUSE_MAX_BUFFERED calls are waiting, then the oldest are dropped.
+// The same goes for creating the table when ClickHouse was down at start.
+type clickHouseSink struct {
+	*clickHouse
+	sync.Mutex
+	rows        []clickHouseRow
+	flushRows   int
+	maxBuffered int
+	dropped     int64
+	full        chan struct{}
+	created     bool
+}
+
+func newClickHouseSink(ch *clickHouse) *clickHouseSink {
+	return &clickHouseSink{
+		clickHouse:  ch,
+		flushRows:   viper.GetInt("CLICKHOUSE_FLUSH_ROWS"),
+		maxBuffered: viper.GetInt("CLICKHOUSE_MAX_BUFFERED"),
+		full:        make(chan struct{}, 1),
+	}
+}
+
+// add buffers calls for the next insert, it never waits for ClickHouse.
+func (s *clickHouseSink) add(calls []Call) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, c := range calls {
+		s.rows = append(s.rows, newClickHouseRow(c))
+	}
+	if over := len(s.rows) - s.maxBuffered; over > 0 {
+		s.rows = s.rows[over:]
+		s.dropped += int64(over)
+	}
+
+	if len(s.rows) >= s.flushRows {
+		select {
+		case s.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ready reports whether the table has been created.
+func (s *clickHouseSink) ready() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.created
+}
+
+// createTable creates the table unless it is known to exist already.
+func (s *clickHouseSink) createTable() error {
+	if s.ready() {
+		return nil
+	}
+	if err := s.clickHouse.createTable(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.created = true
+	s.Unlock()
+	return nil
+}
+
+// flush inserts the buffered calls. Calls added meanwhile wait for the next
+// flush.
+func (s *clickHouseSink) flush() error {
+	if err := s.createTable(); err != nil {
+		return err
+	}
+
+	s.Lock()
+	rows := s.rows
+	s.rows = nil
+	dropped := s.dropped
+	s.dropped = 0
+	s.Unlock()
+
+	if dropped > 0 {
+		log.Error().Msgf("dropped %d calls that couldn't be copied to clickhouse", dropped)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	if err := s.insert(rows); err != nil {
+		// put them back in front of the calls that came in meanwhile
+		s.Lock()
+		s.rows = append(rows, s.rows...)
+		if over := len(s.rows) - s.maxBuffered; over > 0 {
+			s.rows = s.rows[over:]
+			s.dropped += int64(over)
+		}
+		s.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// run flushes the sink every interval, and whenever enough calls are buffered.
+func (s *clickHouseSink) run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	for {
+		select {
+		case <-tick.C:
+		case <-s.full:
+		}
+		if err := s.flush(); err != nil {
+			log.Error().Err(err).Msg("can't copy calls to clickhouse")
+		}
+	}
+}
+
+// backfillClickHouse copies the calls that were received before the sink was
+// enabled, in batches of batch calls. Calls are copied newest first, from the
+// oldest call in ClickHouse down, so that an interrupted backfill picks up
+// where it left off.
+func backfillClickHouse(batch int) (int64, error) {
+	var total int64
+
+	ch := newClickHouse()
+	if err := ch.createTable(); err != nil {
+		return total, err
+	}
+
+	var oldest struct {
+		Count  int64
+		Oldest string
+	}
+	err := ch.query("SELECT count() AS count, toString(min(timestamp)) AS oldest FROM calls", nil, func() interface{} { return &oldest })
+	if err != nil {
+		return total, err
+	}
+
+	// without calls in ClickHouse the sink isn't running yet, all calls are copied
+	gq := db.Where("timestamp <= ?", time.Now())
+	var boundary time.Time
+	var copied map[string]int
+	if oldest.Count > 0 {
+		boundary, err = time.ParseInLocation(clickHouseTimeLayout, oldest.Oldest, time.UTC)
+		if err != nil {
+			return total, err
+		}
+		// the calls of the oldest timestamp might only be copied in part, by
+		// the sink or by an interrupted backfill
+		if copied, err = ch.copiedAt(boundary); err != nil {
+			return total, err
+		}
+		gq = db.Where("timestamp <= ?", boundary)
+	}
+
+	for {
+		var calls []Call
+		if err := gq.Order("timestamp desc, id desc").Limit(batch).Find(&calls).Error; err != nil {
+			return total, err
+		}
+		if len(calls) == 0 {
+			return total, nil
+		}
+
+		rows := make([]clickHouseRow, 0, len(calls))
+		for _, c := range calls {
+			row := newClickHouseRow(c)
+			if c.Timestamp.Equal(boundary) {
+				if k := backfillKey(row); copied[k] > 0 {
+					copied[k]--
+					continue
+				}
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) > 0 {
+			if err := ch.insert(rows); err != nil {
+				return total, err
+			}
+		}
+
+		total += int64(len(rows))
+		log.Debug().Msgf("copied %d calls to clickhouse", total)
+
+		last := calls[len(calls)-1]
+		gq = db.Where("timestamp < ? OR (timestamp = ? AND id < ?)", last.Timestamp, last.Timestamp, last.ID)
+	}
+}
+
+// copiedAt counts the calls in ClickHouse with timestamp ts by backfillKey.
+func (ch *clickHouse) copiedAt(ts time.Time) (map[string]int, error) {
+	var rows []clickHouseRow
+	err := ch.query(`SELECT organisation, repository, event, origin, toString(client_timestamp) AS client_timestamp, payload
+		FROM calls WHERE timestamp = fromUnixTimestamp64Micro({ts:Int64})`,
+		map[string]string{"ts": fmt.Sprint(ts.UnixMicro())}, func() interface{} {
+			rows = append(rows, clickHouseRow{})
+			return &rows[len(rows)-1]
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	copied := map[string]int{}
+	for _, r := range rows {
+		copied[backfillKey(r)]++
+	}
+	return copied, nil
+}
+
+// backfillKey tells calls with the same timestamp apart by everything else
+// that is copied. Payloads are compared as JSON, as the primary store might
+// not return them as they were copied.
+func backfillKey(r clickHouseRow) string {
+	payload := r.Payload
+	var v interface{}
+	if err := json.Unmarshal([]byte(payload), &v); err == nil {
+		if b, err := json.Marshal(v); err == nil {
+			payload = string(b)
+		}
+	}
+
+	var clientTS string
+	if r.ClientTimestamp != nil {
+		if ts, err := time.ParseInLocation(clickHouseTimeLayout, *r.ClientTimestamp, time.UTC); err == nil {
+			clientTS = fmt.Sprint(ts.UnixMicro())
+		}
+	}
+
+	return strings.Join([]string{r.Organisation, r.Repository, r.Event, r.Origin, clientTS, payload}, "\x00")
+}
+
+// analyticsStore stores calls in the primary store and copies them to
+// ClickHouse. With CLICKHOUSE_QUERIES the counts and series are answered by
+// ClickHouse, everything else by the primary store.
+type analyticsStore struct {
+	Store
+	sink    *clickHouseSink
+	queries bool
+}
+
+// initAnalytics wraps the store in an analyticsStore when ANALYTICS_SINK is
+// set, creates the ClickHouse table and starts copying calls to it. When
+// ClickHouse can't be reached the sink keeps trying to create the table.
+func initAnalytics() (*clickHouseSink, error) {
+	switch viper.GetString("ANALYTICS_SINK") {
+	case "":
+		return nil, nil
+	case analyticsSinkClickHouse:
+	default:
+		return nil, fmt.Errorf("unknown analytics sink '%s', expected %s", viper.GetString("ANALYTICS_SINK"), analyticsSinkClickHouse)
+	}
+
+	sink := newClickHouseSink(newClickHouse())
+	if err := sink.createTable(); err != nil {
+		log.Error().Err(err).Msg("can't create the clickhouse table, retrying with the next flush")
+	}
+	go sink.run(viper.GetDuration("CLICKHOUSE_FLUSH_INTERVAL"))
+
+	analyticsSink = sink
+	store = analyticsStore{Store: store, sink: sink, queries: viper.GetBool("CLICKHOUSE_QUERIES")}
+	return sink, nil
+}
+
+// useClickHouse reports whether ClickHouse answers the counts of fq. It has
+// no rollups, so counts that keep including expired calls through the
+// rollups of the primary store are answered by the primary store, and so are
+// all counts until the table is created.
+func (as analyticsStore) useClickHouse(fq FilterQuery) (bool, error) {
+	if !as.queries || !as.sink.ready() {
+		return false, nil
+	}
+	if !rollupUsable(fq) {
+		return true, nil
+	}
+
+	rp, err := retentionPolicyFor(fq.Organisation, fq.Repository)
+	if err != nil {
+		return false, err
+	}
+	return rp.days <= 0 || !rp.rollup, nil
+}
+
+func (as analyticsStore) RegisterCalls(calls []Call) error {
+	if err := as.Store.RegisterCalls(calls); err != nil {
+		return err
+	}
+	as.sink.add(calls)
+	return nil
+}
+
+func (as analyticsStore) CountCalls(fq FilterQuery) (int64, error) {
+	ch, err := as.useClickHouse(fq)
+	if err != nil {
+		return 0, err
+	}
+	if !ch {
+		return as.Store.CountCalls(fq)
+	}
+	return as.sink.CountCalls(fq)
+}
+
+func (as analyticsStore) CountByDate(fq FilterQuery) (DayCounts, error) {
+	ch, err := as.useClickHouse(fq)
+	if err != nil {
+		return nil, err
+	}
+	if !ch {
+		return as.Store.CountByDate(fq)
+	}
+	return as.sink.CountByDate(fq)
+}
+
+func (as analyticsStore) CountSeries(fq FilterQuery) (SeriesCounts, error) {
+	ch, err := as.useClickHouse(fq)
+	if err != nil {
+		return SeriesCounts{}, err
+	}
+	if !ch {
+		return as.Store.CountSeries(fq)
+	}
+	return as.sink.CountSeries(fq)
+}
+
+func (as analyticsStore) CountByEvent(fq FilterQuery) (ValueCounts, error) {
+	ch, err := as.useClickHouse(fq)
+	if err != nil {
+		return nil, err
+	}
+	if !ch {
+		return as.Store.CountByEvent(fq)
+	}
+	return as.sink.CountByEvent(fq)
+}
+
+func (as analyticsStore) CountGroupBy(fq FilterQuery) (ValueCounts, error) {
+	ch, err := as.useClickHouse(fq)
+	if err != nil {
+		return nil, err
+	}
+	if !ch {
+		return as.Store.CountGroupBy(fq)
+	}
+	return as.sink.CountGroupBy(fq)
+}
+
+func (as analyticsStore) CountByDateGroupBy(fq FilterQuery) ([]ValueDayCounts, error) {
+	ch, err := as.useClickHouse(fq)
+	if err != nil {
+		return nil, err
+	}
+	if !ch {
+		return as.Store.CountByDateGroupBy(fq)
+	}
+	return as.sink.CountByDateGroupBy(fq)
+}
+
+// expireCalls deletes the calls that are past the retention of their
+// repository. Deletes are mutations that rewrite whole parts of the table,
+// so they only run when there are expired calls.
+func (ch *clickHouse) expireCalls(now time.Time, def retentionPolicy, overrides map[string]retentionPolicy) error {
+	cutoff := func(days int) (string, error) {
+		until, err := dayStart(now.In(serverLocation).AddDate(0, 0, -days).Format(YYYYMMDDLayout))
+		return fmt.Sprint(until.UnixMicro()), err
+	}
+
+	repos := make([]string, 0, len(overrides))
+	for r := range overrides {
+		repos = append(repos, r)
+	}
+	sort.Strings(repos)
+
+	params := map[string]string{}
+	var conds, others []string
+	for i, r := range repos {
+		others = append(others, fmt.Sprintf("{r%d:String}", i))
+		params[fmt.Sprintf("r%d", i)] = r
+
+		if overrides[r].days <= 0 {
+			continue
+		}
+		c, err := cutoff(overrides[r].days)
+		if err != nil {
+			return err
+		}
+		params[fmt.Sprintf("c%d", i)] = c
+		conds = append(conds, fmt.Sprintf("(concat(organisation, '/', repository) = {r%d:String} AND timestamp < fromUnixTimestamp64Micro({c%d:Int64}))", i, i))
+	}
+
+	if def.days > 0 {
+		c, err := cutoff(def.days)
+		if err != nil {
+			return err
+		}
+		params["c"] = c
+		cond := "timestamp < fromUnixTimestamp64Micro({c:Int64})"
+		if len(others) > 0 {
+			cond = "(" + cond + " AND concat(organisation, '/', repository) NOT IN (" + strings.Join(others, ", ") + "))"
+		}
+		conds = append(conds, cond)
+	}
+
+	if len(conds) == 0 {
+		return nil
+	}
+	where := strings.Join(conds, " OR ")
+
+	var expired struct{ Count int64 }
+	if err := ch.query("SELECT count() AS count FROM calls WHERE "+where, params, func() interface{} { return &expired }); err != nil {
+		return err
+	}
+	if expired.Count == 0 {
+		return nil
+	}
+
+	body, err := ch.exec("ALTER TABLE calls DELETE WHERE "+where, params, nil)
+	if err != nil {
+		return err
+	}
+	log.Debug().Msgf("deleting %d expired calls from clickhouse", expired.Count)
+	return body.Close()
+}
+
+// clickHouseQuery holds the parts of a query on the calls that are the same
+// for all counts. Filters behave as in Postgres: values compare as ->>
+// returns them.
+type clickHouseQuery struct {
+	where  string
+	params map[string]string
+	count  string
+	time   string
+	tz     string
+}
+
+// clickHouseText is the value of key in the payload as ->> returns it, the
+// string itself for strings and JSON for other values.
+func clickHouseText(key string) string {
+	return fmt.Sprintf("if(JSONType(payload, %[1]s) = 'String', JSONExtractString(payload, %[1]s), JSONExtractRaw(payload, %[1]s))", key)
+}
+
+func newClickHouseQuery(fq FilterQuery) (clickHouseQuery, error) {
+	pfs, loc, err := checkFilterQuery(fq)
+	if err != nil {
+		return clickHouseQuery{}, err
+	}
+
+	cq := clickHouseQuery{
+		params: map[string]string{"org": fq.Organisation, "repo": fq.Repository, "tz": loc.String()},
+		count:  "count()",
+		time:   "timestamp",
+		tz:     "{tz:String}",
+	}
+	if fq.Unique {
+		cq.count = "uniqExact(origin)"
+	}
+	if fq.TimeField == timeFieldClient {
+		cq.time = "coalesce(client_timestamp, timestamp)"
+	}
+
+	conds := []string{"organisation = {org:String}", "repository = {repo:String}"}
+
+	if fq.Event != "" {
+		conds = append(conds, "event = {event:String}")
+		cq.params["event"] = fq.Event
+	}
+
+	if fq.Key != "" {
+		conds = append(conds, "JSONHas(payload, {key:String})")
+		cq.params["key"] = fq.Key
+	}
+
+	for i, pf := range pfs {
+		key := fmt.Sprintf("{k%d:String}", i)
+		cq.params[fmt.Sprintf("k%d", i)] = pf.Key
+		cq.params[fmt.Sprintf("v%d", i)] = pf.Value
+
+		switch pf.Op {
+		case "eq":
+			conds = append(conds, fmt.Sprintf("(JSONType(payload, %s) != 'Null' AND %s = {v%d:String})", key, clickHouseText(key), i))
+		case "ne":
+			conds = append(conds, fmt.Sprintf("NOT (JSONType(payload, %s) != 'Null' AND %s = {v%d:String})", key, clickHouseText(key), i))
+		default:
+			// only compare numbers, other values never match
+			conds = append(conds, fmt.Sprintf("(JSONType(payload, %s) IN ('Int64', 'UInt64', 'Double') AND JSONExtractFloat(payload, %s) %s {v%d:Float64})",
+				key, key, payloadFilterOps[pf.Op], i))
+		}
+	}
+
+	if fq.FromDate != nil {
+		conds = append(conds, cq.time+" >= fromUnixTimestamp64Micro({from:Int64})")
+		cq.params["from"] = fmt.Sprint(fq.FromDate.In(loc).UnixMicro())
+	}
+
+	if fq.ToDate != nil {
+		conds = append(conds, cq.time+" < fromUnixTimestamp64Micro({to:Int64})")
+		cq.params["to"] = fmt.Sprint(fq.ToDate.In(loc).UnixMicro())
+	}
+
+	cq.where = strings.Join(conds, " AND ")
+	return cq, nil
+}
+
+// groupBy limits the query to the calls with key in their payload and
+// returns the expression of its value, empty for null.
+func (cq *clickHouseQuery) groupBy(key string) string {
+	cq.params["group"] = key
+	cq.where += " AND JSONHas(payload, {group:String})"
+	return "if(JSONType(payload, {group:String}) = 'Null', '', " + clickHouseText("{group:String}") + ")"
+}
+
+func (cq clickHouseQuery) date() string {
+	return "toString(toDate(" + cq.time + ", " + cq.tz + "))"
+}
+
+func (ch *clickHouse) CountCalls(fq FilterQuery) (int64, error) {
+	var row struct{ Count int64 }
+
+	cq, err := newClickHouseQuery(fq)
+	if err != nil {
+		return 0, err
+	}
+
+	err = ch.query("SELECT "+cq.count+" AS count FROM calls WHERE "+cq.where, cq.params, func() interface{} { return &row })
+	return row.Count, err
+}
+
+func (ch *clickHouse) CountByDate(fq FilterQuery) (DayCounts, error) {
+	dc := DayCounts{}
+
+	cq, err := newClickHouseQuery(fq)
+	if err != nil {
+		return dc, err
+	}
+
+	err = ch.query("SELECT "+cq.date()+" AS date, "+cq.count+" AS count FROM calls WHERE "+cq.where+" GROUP BY date ORDER BY date",
+		cq.params, func() interface{} {
+			dc = append(dc, DayCount{})
+			return &dc[len(dc)-1]
+		})
+	return dc, err
+}
+
+func (ch *clickHouse) CountSeries(fq FilterQuery) (SeriesCounts, error) {
+	var rows []struct {
+		Bucket string
+		Count  int64
+	}
+
+	interval, err := seriesInterval(fq)
+	if err != nil {
+		return SeriesCounts{}, err
+	}
+
+	cq, err := newClickHouseQuery(fq)
+	if err != nil {
+		return SeriesCounts{}, err
+	}
+
+	loc, err := filterLocation(fq)
+	if err != nil {
+		return SeriesCounts{}, err
+	}
+
+	var bucket string
+	switch interval {
+	case "hour":
+		bucket = "toStartOfHour(" + cq.time + ", " + cq.tz + ")"
+	case "week":
+		bucket = "toMonday(" + cq.time + ", " + cq.tz + ")"
+	case "month":
+		bucket = "toStartOfMonth(" + cq.time + ", " + cq.tz + ")"
+	default:
+		bucket = "toDate(" + cq.time + ", " + cq.tz + ")"
+	}
+
+	err = ch.query("SELECT toString(toDateTime("+bucket+", "+cq.tz+")) AS bucket, "+cq.count+" AS count FROM calls WHERE "+cq.where+
+		" GROUP BY bucket ORDER BY bucket", cq.params, func() interface{} {
+		rows = append(rows, struct {
+			Bucket string
+			Count  int64
+		}{})
+		return &rows[len(rows)-1]
+	})
+	if err != nil {
+		return SeriesCounts{}, err
+	}
+
+	var first time.Time
+	counts := map[string]int64{}
+	for _, r := range rows {
+		b, err := time.ParseInLocation(clickHouseTimeLayout, r.Bucket, loc)
+		if err != nil {
+			return SeriesCounts{}, err
+		}
+		if first.IsZero() {
+			first = b
+		}
+		counts[b.Format(seriesBucketKey)] += r.Count
+	}
+
+	return fillSeries(fq, interval, loc, first, counts)
+}
+
+func (ch *clickHouse) CountByEvent(fq FilterQuery) (ValueCounts, error) {
+	vc := ValueCounts{}
+
+	cq, err := newClickHouseQuery(fq)
+	if err != nil {
+		return vc, err
+	}
+
+	err = ch.query("SELECT event AS value, "+cq.count+" AS count FROM calls WHERE "+cq.where+" GROUP BY value ORDER BY count DESC, value ASC",
+		cq.params, func() interface{} {
+			vc = append(vc, ValueCount{})
+			return &vc[len(vc)-1]
+		})
+	return vc, err
+}
+
+func (ch *clickHouse) CountGroupBy(fq FilterQuery) (ValueCounts, error) {
+	vc := ValueCounts{}
+
+	cq, err := newClickHouseQuery(fq)
+	if err != nil {
+		return vc, err
+	}
+
+	value := cq.groupBy(fq.GroupBy)
+	err = ch.query("SELECT "+value+" AS value, "+cq.count+" AS count FROM calls WHERE "+cq.where+" GROUP BY value ORDER BY count DESC, value ASC",
+		cq.params, func() interface{} {
+			vc = append(vc, ValueCount{})
+			return &vc[len(vc)-1]
+		})
+	return vc, err
+}
+
+func (ch *clickHouse) CountByDateGroupBy(fq FilterQuery) ([]ValueDayCounts, error) {
+	vdc := []ValueDayCounts{}
+	var rows []struct {
+		Date  string
+		Value string
+		Count int64
+	}
+
+	cq, err := newClickHouseQuery(fq)
+	if err != nil {
+		return vdc, err
+	}
+
+	value := cq.groupBy(fq.GroupBy)
+	err = ch.query("SELECT "+cq.date()+" AS date, "+value+" AS value, "+cq.count+" AS count FROM calls WHERE "+cq.where+
+		" GROUP BY date, value ORDER BY value ASC, date ASC", cq.params, func() interface{} {
+		rows = append(rows, struct {
+			Date  string
+			Value string
+			Count int64
+		}{})
+		return &rows[len(rows)-1]
+	})
+	if err != nil {
+		return vdc, err
+	}
+
+	// rows are ordered by value so each series is contiguous
+	for _, r := range rows {
+		if len(vdc) == 0 || vdc[len(vdc)-1].Value != r.Value {
+			vdc = append(vdc, ValueDayCounts{Value: r.Value, Data: DayCounts{}})
+		}
+		last := &vdc[len(vdc)-1]
+		last.Data = append(last.Data, DayCount{Date: r.Date, Count: r.Count})
+	}
+
+	return vdc, nil
+}
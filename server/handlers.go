@@ -1,21 +1,18 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/gin-gonic/gin"
 )
 
-func getCountCalls(fq FilterQuery) (int64, error) {
+func (postgresStore) CountCalls(fq FilterQuery) (int64, error) {
 	var count int64
 
 	gq, err := callsQueryBuilder(fq)
@@ -23,15 +20,35 @@ func getCountCalls(fq FilterQuery) (int64, error) {
 		return count, err
 	}
 
+	wm, err := rollupWatermark(fq)
+	if err != nil {
+		return count, err
+	}
+
+	var rolledUp int64
+	if wm != "" {
+		err := rollupQueryBuilder(fq, wm).Select("coalesce(sum(" + rollupCountColumn(fq) + "), 0)").Scan(&rolledUp).Error
+		if err != nil {
+			return count, err
+		}
+		if gq, err = sinceWatermark(gq, wm); err != nil {
+			return count, err
+		}
+	}
+
+	if fq.Unique {
+		gq = gq.Distinct("origin")
+	}
+
 	result := gq.Model(&Call{}).Count(&count)
 	if result.Error != nil {
 		return count, result.Error
 	}
 
-	return count, nil
+	return count + rolledUp, nil
 }
 
-func getCountCallsByDate(fq FilterQuery) (DayCounts, error) {
+func (postgresStore) CountByDate(fq FilterQuery) (DayCounts, error) {
 	dc := DayCounts{}
 
 	gq, err := callsQueryBuilder(fq)
@@ -39,10 +56,31 @@ func getCountCallsByDate(fq FilterQuery) (DayCounts, error) {
 		return dc, err
 	}
 
+	loc, err := filterLocation(fq)
+	if err != nil {
+		return dc, err
+	}
+
+	wm, err := rollupWatermark(fq)
+	if err != nil {
+		return dc, err
+	}
+
+	rolledUp := DayCounts{}
+	if wm != "" {
+		err := rollupQueryBuilder(fq, wm).Select("day as date, " + rollupCountColumn(fq) + " as count").Order("day asc").Find(&rolledUp).Error
+		if err != nil {
+			return dc, err
+		}
+		if gq, err = sinceWatermark(gq, wm); err != nil {
+			return dc, err
+		}
+	}
+
 	res := gq.Model(&Call{}).
-		Group("timestamp::date").
-		Select("timestamp::date as date, count(*) as count").
-		Order("timestamp::date asc").
+		Select("("+timeColumn(fq)+" AT TIME ZONE ?)::date as date, "+countExpr(fq)+" as count", loc.String()).
+		Group("date").
+		Order("date asc").
 		Find(&dc)
 	if res.Error != nil {
 		return dc, res.Error
@@ -53,7 +91,204 @@ func getCountCallsByDate(fq FilterQuery) (DayCounts, error) {
 		dc[i].Date = strings.Split(v.Date, "T")[0]
 	}
 
-	return dc, nil
+	// rolled up days all come before the watermark
+	return append(rolledUp, dc...), nil
+}
+
+func (postgresStore) CountGroupBy(fq FilterQuery) (ValueCounts, error) {
+	vc := ValueCounts{}
+
+	gq, err := callsQueryBuilder(fq)
+	if err != nil {
+		return vc, err
+	}
+
+	gq, value, args := groupByValue(gq.Model(&Call{}), fq.GroupBy)
+	res := gq.Select(value+" as value, "+countExpr(fq)+" as count", args...).
+		Group("value").
+		Order("count desc, value asc").
+		Find(&vc)
+	if res.Error != nil {
+		return vc, res.Error
+	}
+
+	return vc, nil
+}
+
+func (postgresStore) CountByEvent(fq FilterQuery) (ValueCounts, error) {
+	vc := ValueCounts{}
+
+	gq, err := callsQueryBuilder(fq)
+	if err != nil {
+		return vc, err
+	}
+
+	wm, err := rollupWatermark(fq)
+	if err != nil {
+		return vc, err
+	}
+
+	var rolledUp ValueCounts
+	if wm != "" {
+		rq := rollupDaysQueryBuilder(fq, wm).Where("event <> ?", rollupAllEvents)
+		if fq.Event != "" {
+			rq = rq.Where("event = ?", fq.Event)
+		}
+		err := rq.Select("event as value, sum(" + rollupCountColumn(fq) + ") as count").Group("event").Find(&rolledUp).Error
+		if err != nil {
+			return vc, err
+		}
+		if gq, err = sinceWatermark(gq, wm); err != nil {
+			return vc, err
+		}
+	}
+
+	res := gq.Model(&Call{}).
+		Select("event as value, " + countExpr(fq) + " as count").
+		Group("event").
+		Order("count desc, value asc").
+		Find(&vc)
+	if res.Error != nil {
+		return vc, res.Error
+	}
+
+	if len(rolledUp) == 0 {
+		return vc, nil
+	}
+
+	counts := map[string]int64{}
+	for _, v := range append(rolledUp, vc...) {
+		counts[v.Value] += v.Count
+	}
+	vc = ValueCounts{}
+	for v, n := range counts {
+		vc = append(vc, ValueCount{Value: v, Count: n})
+	}
+	sort.Slice(vc, func(i, j int) bool {
+		if vc[i].Count != vc[j].Count {
+			return vc[i].Count > vc[j].Count
+		}
+		return vc[i].Value < vc[j].Value
+	})
+
+	return vc, nil
+}
+
+func (postgresStore) CountByDateGroupBy(fq FilterQuery) ([]ValueDayCounts, error) {
+	vdc := []ValueDayCounts{}
+	var rows []struct {
+		Date  string
+		Value string
+		Count int64
+	}
+
+	gq, err := callsQueryBuilder(fq)
+	if err != nil {
+		return vdc, err
+	}
+
+	loc, err := filterLocation(fq)
+	if err != nil {
+		return vdc, err
+	}
+
+	gq, value, args := groupByValue(gq.Model(&Call{}), fq.GroupBy)
+	res := gq.Select("("+timeColumn(fq)+" AT TIME ZONE ?)::date as date, "+value+" as value, "+countExpr(fq)+" as count",
+		append([]interface{}{loc.String()}, args...)...).
+		Group("date, value").
+		Order("value asc, date asc").
+		Find(&rows)
+	if res.Error != nil {
+		return vdc, res.Error
+	}
+
+	// rows are ordered by value so each series is contiguous
+	for _, r := range rows {
+		if len(vdc) == 0 || vdc[len(vdc)-1].Value != r.Value {
+			vdc = append(vdc, ValueDayCounts{Value: r.Value, Data: DayCounts{}})
+		}
+		last := &vdc[len(vdc)-1]
+		last.Data = append(last.Data, DayCount{Date: strings.Split(r.Date, "T")[0], Count: r.Count})
+	}
+
+	return vdc, nil
+}
+
+// CountSeries counts calls per interval bucket in the requested time
+// zone. Buckets without calls between from_date (or the first call) and
+// to_date (or now) are filled with a zero count.
+func (postgresStore) CountSeries(fq FilterQuery) (SeriesCounts, error) {
+	sc := SeriesCounts{}
+	var rows []struct {
+		Bucket time.Time
+		Count  int64
+	}
+
+	interval, err := seriesInterval(fq)
+	if err != nil {
+		return sc, err
+	}
+
+	gq, err := callsQueryBuilder(fq)
+	if err != nil {
+		return sc, err
+	}
+
+	loc, err := filterLocation(fq)
+	if err != nil {
+		return sc, err
+	}
+
+	// rollups are per day, so they can't fill hourly buckets
+	wm := ""
+	if interval != "hour" {
+		if wm, err = rollupWatermark(fq); err != nil {
+			return sc, err
+		}
+	}
+
+	var rolledUp DayCounts
+	if wm != "" {
+		err := rollupQueryBuilder(fq, wm).Select("day as date, " + rollupCountColumn(fq) + " as count").Order("day asc").Find(&rolledUp).Error
+		if err != nil {
+			return sc, err
+		}
+		if gq, err = sinceWatermark(gq, wm); err != nil {
+			return sc, err
+		}
+	}
+
+	res := gq.Model(&Call{}).
+		Select("date_trunc(?, "+timeColumn(fq)+" AT TIME ZONE ?) as bucket, "+countExpr(fq)+" as count", interval, loc.String()).
+		Group("bucket").
+		Order("bucket asc").
+		Find(&rows)
+	if res.Error != nil {
+		return sc, res.Error
+	}
+
+	// buckets come back as wall clock times of loc
+	var first time.Time
+	counts := map[string]int64{}
+	for _, dc := range rolledUp {
+		day, err := time.ParseInLocation(YYYYMMDDLayout, dc.Date, loc)
+		if err != nil {
+			return sc, err
+		}
+		if first.IsZero() {
+			first = day
+		}
+		counts[truncateToInterval(day, interval).Format(seriesBucketKey)] += dc.Count
+	}
+	for _, r := range rows {
+		if first.IsZero() {
+			b := r.Bucket
+			first = time.Date(b.Year(), b.Month(), b.Day(), b.Hour(), 0, 0, 0, loc)
+		}
+		counts[r.Bucket.Format(seriesBucketKey)] += r.Count
+	}
+
+	return fillSeries(fq, interval, loc, first, counts)
 }
 
 // @Summary      shield.io badge information.
@@ -61,8 +296,12 @@ func getCountCallsByDate(fq FilterQuery) (DayCounts, error) {
 // @Description  Check out the documentation at [shields.io](https://shields.io/endpoint) for more details.
 // @Param        organisation  path   string  true   "github organisation"
 // @Param        repository    path   string  true   "repository name"
+// @Param        key           query  string  false  "filter by key passed in POST payload"
+// @Param        where         query  []string  false  "filter on payload values as key:op:value, op is one of eq, ne, gt, gte, lt, lte"  collectionFormat(multi)
+// @Param        event         query  string  false  "filter by event name"
 // @Produce      json
 // @Success      200  {object}  BadgeInfo
+// @Security     BearerAuth
 // @Router       /{organisation}/{repository}/count/badge [get]
 func getCountCallsBadgeHandler(c *gin.Context) {
 	var or OrgRepoURI
@@ -72,9 +311,14 @@ func getCountCallsBadgeHandler(c *gin.Context) {
 	}
 
 	fq := FilterQuery{}
+	c.ShouldBind(&fq)
+	if err := bindFilterDates(c, &fq); err != nil {
+		c.JSON(http.StatusBadRequest, DefaultResp{Error: err.Error()})
+		return
+	}
 	fq.AddOrgRepo(or)
 
-	count, err := getCountCalls(fq)
+	count, err := store.CountCalls(fq)
 	if err != nil {
 		resp := DefaultResp{Error: err.Error()}
 		c.JSON(http.StatusBadRequest, resp)
@@ -87,13 +331,18 @@ func getCountCallsBadgeHandler(c *gin.Context) {
 
 // @Summary      Count telemetry calls.
 // @Description  Count telemetry calls with optional filtering.
+// @Description  When `group_by` is set, data holds a count per distinct value of that key (see GroupedCountResp).
 // @Param        organisation  path   string  true   "github organisation"
 // @Param        repository    path   string  true   "repository name"
 // @Param        key           query  string  false  "filter by key passed in POST payload"
+// @Param        where         query  []string  false  "filter on payload values as key:op:value, op is one of eq, ne, gt, gte, lt, lte"  collectionFormat(multi)
+// @Param        event         query  string  false  "filter by event name"
 // @Param        from_date     query  string  false  "from date to filter on"
 // @Param        to_date       query  string  false  "to date to filter on"
+// @Param        group_by      query  string  false  "count per distinct value of this key passed in POST payload"
 // @Produce      json
-// @Success      200  {array}  Call
+// @Success      200  {object}  CountResp
+// @Security     BearerAuth
 // @Router       /{organisation}/{repository}/count [get]
 func getCountCallsHandler(c *gin.Context) {
 	var fq FilterQuery
@@ -108,11 +357,22 @@ func getCountCallsHandler(c *gin.Context) {
 
 	}
 
+	if err := bindFilterDates(c, &fq); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
 	fq.Organisation = or.Organisation
 	fq.Repository = or.Repository
 	resp.Query = &fq
 
-	count, err := getCountCalls(fq)
+	if fq.GroupBy != "" {
+		getCountCallsGroupByHandler(c, fq)
+		return
+	}
+
+	count, err := store.CountCalls(fq)
 	if err != nil {
 		resp.Error = err.Error()
 		c.JSON(http.StatusBadRequest, resp)
@@ -122,15 +382,119 @@ func getCountCallsHandler(c *gin.Context) {
 	c.JSON(200, resp)
 }
 
+// @Summary      Count unique origins.
+// @Description  Count distinct origins (hashed client IPs) that made telemetry calls, with optional filtering.
+// @Description  Use this to estimate the number of installations rather than the number of calls.
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Param        key           query  string  false  "filter by key passed in POST payload"
+// @Param        where         query  []string  false  "filter on payload values as key:op:value, op is one of eq, ne, gt, gte, lt, lte"  collectionFormat(multi)
+// @Param        event         query  string  false  "filter by event name"
+// @Param        from_date     query  string  false  "from date to filter on"
+// @Param        to_date       query  string  false  "to date to filter on"
+// @Param        group_by      query  string  false  "count per distinct value of this key passed in POST payload"
+// @Produce      json
+// @Success      200  {object}  CountResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/count/unique [get]
+func getCountUniqueHandler(c *gin.Context) {
+	var fq FilterQuery
+	var or OrgRepoURI
+	resp := CountResp{}
+
+	c.ShouldBind(&fq)
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := bindFilterDates(c, &fq); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	fq.AddOrgRepo(or)
+	fq.Unique = true
+	resp.Query = &fq
+
+	if fq.GroupBy != "" {
+		getCountCallsGroupByHandler(c, fq)
+		return
+	}
+
+	count, err := store.CountCalls(fq)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	resp.Data = count
+	c.JSON(200, resp)
+}
+
+// @Summary      Count telemetry calls per event.
+// @Description  Count telemetry calls per event name with optional filtering.
+// @Description  Calls registered without an event are counted under an empty value.
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Param        key           query  string  false  "filter by key passed in POST payload"
+// @Param        where         query  []string  false  "filter on payload values as key:op:value, op is one of eq, ne, gt, gte, lt, lte"  collectionFormat(multi)
+// @Param        from_date     query  string  false  "from date to filter on"
+// @Param        to_date       query  string  false  "to date to filter on"
+// @Param        unique        query  bool    false  "count distinct origins instead of calls"
+// @Produce      json
+// @Success      200  {object}  GroupedCountResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/count/events [get]
+func getCountCallsByEventHandler(c *gin.Context) {
+	var fq FilterQuery
+	var or OrgRepoURI
+	resp := GroupedCountResp{}
+
+	c.ShouldBind(&fq)
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := bindFilterDates(c, &fq); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	fq.AddOrgRepo(or)
+	resp.Query = &fq
+
+	vc, err := store.CountByEvent(fq)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	resp.Data = vc
+	c.JSON(200, resp)
+}
+
 // @Summary      Count telemetry calls grouped by date.
 // @Description  Count telemetry calls with optional filtering.
+// @Description  When `group_by` is set, data holds one daily series per distinct value of that key (see GroupedDailyCountResp).
 // @Param        organisation  path   string  true   "github organisation"
 // @Param        repository    path   string  true   "repository name"
 // @Param        key           query  string  false  "filter by key passed in POST payload"
+// @Param        where         query  []string  false  "filter on payload values as key:op:value, op is one of eq, ne, gt, gte, lt, lte"  collectionFormat(multi)
+// @Param        event         query  string  false  "filter by event name"
 // @Param        from_date     query  string  false  "from date to filter on"
 // @Param        to_date       query  string  false  "to date to filter on"
+// @Param        group_by      query  string  false  "one daily series per distinct value of this key passed in POST payload"
+// @Param        unique        query  bool    false  "count distinct origins instead of calls"
+// @Param        time          query  string  false  "time to bucket and filter on: server (default) receive time or client time, falling back to the receive time"
 // @Produce      json
-// @Success      200  {array}  Call
+// @Success      200  {object}  DailyCountResp
+// @Security     BearerAuth
 // @Router       /{organisation}/{repository}/count/daily [get]
 func getCountCallsByDayHandler(c *gin.Context) {
 	var fq FilterQuery
@@ -145,11 +509,22 @@ func getCountCallsByDayHandler(c *gin.Context) {
 
 	}
 
+	if err := bindFilterDates(c, &fq); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
 	fq.Organisation = or.Organisation
 	fq.Repository = or.Repository
 	resp.Query = &fq
 
-	dc, err := getCountCallsByDate(fq)
+	if fq.GroupBy != "" {
+		getCountCallsByDayGroupByHandler(c, fq)
+		return
+	}
+
+	dc, err := store.CountByDate(fq)
 	if err != nil {
 		resp.Error = err.Error()
 		c.JSON(http.StatusBadRequest, resp)
@@ -159,27 +534,135 @@ func getCountCallsByDayHandler(c *gin.Context) {
 	c.JSON(200, resp)
 }
 
-func getCalls(fq FilterQuery) ([]Call, error) {
+// @Summary      Count telemetry calls per time bucket.
+// @Description  Count telemetry calls per hour, day, week or month with optional filtering.
+// @Description  Buckets without calls between `from_date` (or the first call) and `to_date` (or now) have a zero count.
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Param        interval      query  string  false  "bucket size: hour, day (default), week or month"
+// @Param        tz            query  string  false  "IANA time zone to bucket in, e.g. Europe/Brussels"
+// @Param        unique        query  bool    false  "count distinct origins instead of calls"
+// @Param        time          query  string  false  "time to bucket and filter on: server (default) receive time or client time, falling back to the receive time"
+// @Param        key           query  string  false  "filter by key passed in POST payload"
+// @Param        where         query  []string  false  "filter on payload values as key:op:value, op is one of eq, ne, gt, gte, lt, lte"  collectionFormat(multi)
+// @Param        event         query  string  false  "filter by event name"
+// @Param        from_date     query  string  false  "from date to filter on"
+// @Param        to_date       query  string  false  "to date to filter on"
+// @Produce      json
+// @Success      200  {object}  SeriesCountResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/count/series [get]
+func getCountCallsSeriesHandler(c *gin.Context) {
+	var fq FilterQuery
+	var or OrgRepoURI
+	resp := SeriesCountResp{}
+
+	c.ShouldBind(&fq)
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := bindFilterDates(c, &fq); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	fq.AddOrgRepo(or)
+	resp.Query = &fq
+
+	sc, err := store.CountSeries(fq)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	resp.Data = sc
+	c.JSON(200, resp)
+}
+
+func getCountCallsGroupByHandler(c *gin.Context, fq FilterQuery) {
+	resp := GroupedCountResp{}
+	resp.Query = &fq
+
+	vc, err := store.CountGroupBy(fq)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	resp.Data = vc
+	c.JSON(200, resp)
+}
+
+func getCountCallsByDayGroupByHandler(c *gin.Context, fq FilterQuery) {
+	resp := GroupedDailyCountResp{}
+	resp.Query = &fq
+
+	vdc, err := store.CountByDateGroupBy(fq)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	resp.Data = vdc
+	c.JSON(200, resp)
+}
+
+// ListCalls returns a page of calls ordered by (timestamp, id) together with
+// the cursor pointing to the next page, which is empty on the last page.
+func (postgresStore) ListCalls(fq FilterQuery) ([]Call, string, error) {
 	var calls []Call
 
 	gq, err := callsQueryBuilder(fq)
 	if err != nil {
-		return calls, err
+		return calls, "", err
+	}
+
+	limit := fq.Limit
+	if limit <= 0 || limit > getCallsLimit {
+		limit = getCallsLimit
+	}
+
+	if fq.Cursor != "" {
+		ts, id, err := decodeCursor(fq.Cursor)
+		if err != nil {
+			return calls, "", err
+		}
+		gq = gq.Where("(timestamp, id) > (?, ?)", ts, id)
+	}
+
+	// fetch one extra row to know whether there is a next page
+	r := gq.Order("timestamp asc, id asc").Limit(limit + 1).Find(&calls)
+	if r.Error != nil {
+		return calls, "", r.Error
 	}
 
-	r := gq.Find(&calls).Limit(getCallsLimit)
-	return calls, r.Error
+	if len(calls) <= limit {
+		return calls, "", nil
+	}
+
+	calls = calls[:limit]
+	return calls, encodeCursor(calls[limit-1]), nil
 }
 
 // @Summary      Fetch telemetry calls.
 // @Description  Fetch telemetry calls with optional filtering.
+// @Description  Calls are ordered by timestamp. Pass the returned `next_cursor` as `cursor` to fetch the next page.
 // @Param        organisation  path   string  true   "github organisation"
 // @Param        repository    path   string  true   "repository name"
 // @Param        key           query  string  false  "filter by key passed in POST payload"
+// @Param        where         query  []string  false  "filter on payload values as key:op:value, op is one of eq, ne, gt, gte, lt, lte"  collectionFormat(multi)
+// @Param        event         query  string  false  "filter by event name"
 // @Param        from_date     query  string  false  "from date to filter on"
 // @Param        to_date       query  string  false  "to date to filter on"
+// @Param        limit         query  int     false  "maximum number of calls to return (max 3000)"
+// @Param        cursor        query  string  false  "next_cursor of the previous page"
 // @Produce      json
 // @Success      200  {object}  CallsResp
+// @Security     BearerAuth
 // @Router       /{organisation}/{repository} [get]
 func getCallsHandler(c *gin.Context) {
 	var fq FilterQuery
@@ -194,12 +677,18 @@ func getCallsHandler(c *gin.Context) {
 		return
 	}
 
+	if err := bindFilterDates(c, &fq); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
 	fq.Organisation = or.Organisation
 	fq.Repository = or.Repository
 
 	resp.Query = &fq
 
-	cs, err := getCalls(fq)
+	cs, next, err := store.ListCalls(fq)
 	if err != nil {
 		resp.Error = err.Error()
 		c.JSON(http.StatusBadRequest, resp)
@@ -207,6 +696,7 @@ func getCallsHandler(c *gin.Context) {
 	}
 
 	resp.Data = cs
+	resp.NextCursor = next
 	c.JSON(200, resp)
 }
 
@@ -214,24 +704,41 @@ func getCallsHandler(c *gin.Context) {
 // @Description  Register new call.
 // @Description
 // @Description  Requires a JSON body in the shape of `{"foo": "bar", "coffee": 432}`.
-// @Description  Expects either an empty object `{}` or an object that only contains keys and **unnested** values.
-// @Description  Nested objects will be stripped from the payload and a warning message will be returned.
+// @Description  Expects either an empty object `{}` or an object that only contains keys and **unnested** values:
+// @Description  strings, numbers, booleans, null or short arrays of strings, numbers and booleans.
+// @Description  Other values will be stripped from the payload and a warning message will be returned, naming the stripped keys.
+// @Description
+// @Description  Calls can be registered as a named event, e.g. `install`, `command_run` or `crash`, by posting to `/e/{event}`.
+// @Description  Event names have up to 64 letters, digits, `_`, `-`, `.` or `:`.
+// @Description
+// @Description  The time the call actually happened can be passed in the `_ts` key of the payload or the `X-Phonehome-Timestamp` header,
+// @Description  as RFC 3339 or unix seconds. It is stored next to the time the call was received.
+// @Description
+// @Description  Payloads have to stay within the size, key and length limits listed on `/info`.
 // @Accept json
 // @Param        organisation  path   string  true   "github organisation"
 // @Param        repository    path   string  true   "repository name"
-// @Param        repository    path   string  true   "repository name"
+// @Param        event         path   string  true   "event name, e.g. install or crash"
 // @Produce      json
 // @Success      200  {object}  RegisterResp
+// @Failure      413  {object}  RegisterResp
+// @Failure      503  {object}  RegisterResp
+// @Security     BearerAuth
 // @Router       /{organisation}/{repository} [post]
+// @Router       /{organisation}/{repository}/e/{event} [post]
 func registerCallHander(c *gin.Context) {
 	var or OrgRepoURI
 	var call Call
 	var resp RegisterResp
 
 	// read json payload in body
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(c.Request.Body)
-	call.Payload.RawMessage = json.RawMessage(buf.Bytes())
+	body, err := readBody(c, payloadLimits.MaxBytes)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(bodyErrorStatus(err), resp)
+		return
+	}
+	call.Payload.RawMessage = json.RawMessage(body)
 
 	if err := c.ShouldBindUri(&or); err != nil {
 		resp.Error = err.Error()
@@ -241,17 +748,34 @@ func registerCallHander(c *gin.Context) {
 
 	call.Organisation = or.Organisation
 	call.Repository = or.Repository
-	originSha := sha256.Sum256([]byte(c.ClientIP()))
-	call.Origin = hex.EncodeToString(originSha[:])
+	call.Event = c.Param("event")
+
+	if h := c.GetHeader(clientTimestampHeader); h != "" {
+		ts, err := parseClientTimestampHeader(h)
+		if err != nil {
+			resp.Error = err.Error()
+			c.JSON(http.StatusBadRequest, resp)
+			return
+		}
+		call.ClientTimestamp = &ts
+	}
 
-	cpl, stripped, err := registerCall(call)
+	origin, err := callOrigin(c)
 	if err != nil {
 		resp.Error = err.Error()
-		c.JSON(http.StatusBadRequest, resp)
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	call.Origin = origin
+
+	cr, err := registerCall(call)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(ingestErrorStatus(c, err, http.StatusBadRequest), resp)
 		return
 	}
 
-	payloadClean, err := json.Marshal(cpl)
+	payloadClean, err := json.Marshal(cr.payload)
 	if err != nil {
 		resp.Error = err.Error()
 		c.JSON(http.StatusBadRequest, resp)
@@ -259,20 +783,39 @@ func registerCallHander(c *gin.Context) {
 	}
 
 	resp.Payload = payloadClean
-	if stripped {
-		resp.Message = "WARN: payload got stripped of non-allowed content"
+	resp.Redactions = cr.redactions
+	if len(cr.stripped) > 0 {
+		resp.Stripped = cr.stripped
+		resp.Message = "WARN: payload got stripped of non-allowed content: " + describeKeyIssues(cr.stripped)
 	}
-	spew.Dump(call)
 
 	c.JSON(200, resp)
 }
 
-func registerCall(c Call) (CallPayload, bool, error) {
-	var pl CallPayload
-	var stripped bool
+// callReport tells what happened to the payload of a call on its way in.
+type callReport struct {
+	payload    CallPayload
+	stripped   []KeyIssue
+	redactions int
+}
+
+func registerCall(c Call) (callReport, error) {
+	cr, err := prepareCall(&c)
+	if err != nil {
+		return cr, err
+	}
+
+	return cr, store.RegisterCalls([]Call{c})
+}
+
+// prepareCall validates the payload of c and reports it stripped of
+// non-allowed content. The timestamp is set to now unless already known.
+// A client timestamp passed in the payload is moved out of it, see takeClientTimestamp.
+func prepareCall(c *Call) (callReport, error) {
+	var cr callReport
 
 	// still put valid value in jsonb col if body empoty
-	if reflect.DeepEqual(c.Payload.RawMessage, json.RawMessage{}) {
+	if reflect.DeepEqual(c.Payload.RawMessage, json.RawMessage{}) || c.Payload.RawMessage == nil {
 		c.Payload.RawMessage = []byte(`{}`)
 	}
 
@@ -280,21 +823,113 @@ func registerCall(c Call) (CallPayload, bool, error) {
 	// this err might also be raised by unmarshalling
 	// to be checked
 	if !json.Valid(c.Payload.RawMessage) {
-		return pl, stripped, fmt.Errorf("'%s' is invalid JSON", c.Payload.RawMessage)
+		return cr, fmt.Errorf("'%s' is invalid JSON", c.Payload.RawMessage)
+	}
+
+	if err := checkPayloadLimits(c.Payload.RawMessage, payloadLimits); err != nil {
+		return cr, err
+	}
+
+	if c.Event != "" && !eventNameRe.MatchString(c.Event) {
+		return cr, fmt.Errorf("invalid event name '%s'", c.Event)
+	}
+
+	if err := takeClientTimestamp(c); err != nil {
+		return cr, err
 	}
 
 	// make sure that no nested objects are passed
-	err := json.Unmarshal(c.Payload.RawMessage, &pl)
+	err := json.Unmarshal(c.Payload.RawMessage, &cr.payload)
 	if err != nil {
-		return pl, stripped, err
+		return cr, err
+	}
+
+	if err := enforcePayloadSchema(c, cr.payload); err != nil {
+		return cr, err
 	}
 
 	// strip out unwanted stuff
-	pl, stripped = payloadStripper(pl)
-	c.Timestamp = time.Now()
+	cr.payload, cr.stripped = payloadStripper(cr.payload)
+
+	sc, err := scrubberFor(c.Organisation, c.Repository)
+	if err != nil {
+		return cr, err
+	}
+	cr.redactions = sc.scrub(cr.payload)
+
+	// store exactly what is reported, stripped and scrubbed
+	if c.Payload.RawMessage, err = json.Marshal(cr.payload); err != nil {
+		return cr, err
+	}
+
+	if c.Timestamp.IsZero() {
+		c.Timestamp = time.Now()
+	}
+
+	if c.ClientTimestamp != nil {
+		ts, err := checkClientTimestamp(*c.ClientTimestamp, c.Timestamp)
+		if err != nil {
+			return cr, err
+		}
+		c.ClientTimestamp = &ts
+	}
+
+	return cr, nil
+}
 
-	result := db.Create(&c)
-	return pl, stripped, result.Error
+// takeClientTimestamp moves the _ts key out of the payload of c into its
+// client timestamp.
+func takeClientTimestamp(c *Call) error {
+	var pl map[string]json.RawMessage
+	if err := json.Unmarshal(c.Payload.RawMessage, &pl); err != nil {
+		return err
+	}
+	if pl == nil {
+		return fmt.Errorf("'%s' is not a JSON object", c.Payload.RawMessage)
+	}
+
+	rawTs, ok := pl[clientTimestampKey]
+	if !ok {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(rawTs, &v); err != nil {
+		return err
+	}
+	ts, err := parseClientTimestamp(v)
+	if err != nil {
+		return err
+	}
+	c.ClientTimestamp = &ts
+
+	delete(pl, clientTimestampKey)
+	raw, err := json.Marshal(pl)
+	if err != nil {
+		return err
+	}
+	c.Payload.RawMessage = raw
+
+	return nil
+}
+
+// bindFilterDates binds the from_date and to_date query parameters, which
+// gin's form binding can't decode into a JsonDate.
+func bindFilterDates(c *gin.Context, fq *FilterQuery) error {
+	for param, dst := range map[string]**JsonDate{"from_date": &fq.FromDate, "to_date": &fq.ToDate} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+
+		jd := new(JsonDate)
+		if err := jd.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("invalid %s '%s', expected YYYY-MM-DD", param, v)
+		}
+		*dst = jd
+	}
+
+	return nil
 }
 
 func githubRepoExistsMW(c *gin.Context) {
@@ -312,6 +947,7 @@ func githubRepoExistsMW(c *gin.Context) {
 				org, repo),
 		}
 		c.AbortWithStatusJSON(http.StatusBadRequest, resp)
+		return
 	}
 	c.Next()
 }
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,6 +29,13 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// requirePostgres skips tests of features that only the postgres store has.
+func requirePostgres(t *testing.T) {
+	if _, ok := store.(postgresStore); !ok {
+		t.Skip("needs the postgres store")
+	}
+}
+
 func TestRegisterCall(t *testing.T) {
 	type test struct {
 		input     Call
@@ -39,7 +49,7 @@ func TestRegisterCall(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		_, _, err := registerCall(test.input)
+		_, err := registerCall(test.input)
 		t.Log(err)
 		assert.Equal(t, err != nil, test.expectErr)
 	}
@@ -56,7 +66,7 @@ func TestGetCalls(t *testing.T) {
 	testOrg := uuid.NewV1().String()
 	testRepo := uuid.NewV1().String()
 
-	_, _, err := registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(fmt.Sprintf(`{"%s": "am_sheep"}`, testKey))}})
+	_, err := registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(fmt.Sprintf(`{"%s": "am_sheep"}`, testKey))}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,12 +77,48 @@ func TestGetCalls(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		cs, err := getCalls(test.fq)
+		cs, _, err := store.ListCalls(test.fq)
 		assert.Equal(t, test.expectedLen, len(cs))
 		assert.Equal(t, test.expectErr, err != nil)
 	}
 }
 
+func TestGetCallsPagination(t *testing.T) {
+	testOrg := uuid.NewV1().String()
+	testRepo := uuid.NewV1().String()
+
+	for i := 0; i < 5; i++ {
+		_, err := registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(fmt.Sprintf(`{"i": %d}`, i))}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fq := FilterQuery{Organisation: testOrg, Repository: testRepo, Limit: 2}
+	var seen []Call
+	pages := 0
+	for {
+		cs, next, err := store.ListCalls(fq)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(cs), 2)
+		seen = append(seen, cs...)
+		pages++
+		if next == "" {
+			break
+		}
+		fq.Cursor = next
+	}
+
+	assert.Equal(t, 3, pages)
+	assert.Equal(t, 5, len(seen))
+	for i, c := range seen {
+		assert.JSONEq(t, fmt.Sprintf(`{"i": %d}`, i), string(c.Payload.RawMessage))
+	}
+
+	_, _, err := store.ListCalls(FilterQuery{Organisation: testOrg, Repository: testRepo, Cursor: "garbage"})
+	assert.Error(t, err)
+}
+
 func TestCountCalls(t *testing.T) {
 	type test struct {
 		fq          FilterQuery
@@ -86,11 +132,11 @@ func TestCountCalls(t *testing.T) {
 	testRepo := uuid.NewV1().String()
 
 	// run this twice to know what to expect
-	_, _, err := registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(fmt.Sprintf(`{"%s": "am_sheep"}`, testKey))}})
+	_, err := registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(fmt.Sprintf(`{"%s": "am_sheep"}`, testKey))}})
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, _, err = registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(fmt.Sprintf(`{"%s": "am_sheep"}`, testKey))}})
+	_, err = registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(fmt.Sprintf(`{"%s": "am_sheep"}`, testKey))}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -136,12 +182,1192 @@ func TestCountCalls(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		cc, err := getCountCalls(test.fq)
+		cc, err := store.CountCalls(test.fq)
 		assert.Equal(t, test.expectedLen, cc)
 		assert.Equal(t, test.expectErr, err != nil)
 	}
 }
 
+func TestCountCallsGroupBy(t *testing.T) {
+	testOrg := uuid.NewV1().String()
+	testRepo := uuid.NewV1().String()
+
+	for _, pl := range []string{`{"version": "1.0.0"}`, `{"version": "1.1.0"}`, `{"version": "1.1.0"}`, `{"os": "linux"}`} {
+		_, err := registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(pl)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fq := FilterQuery{GroupBy: "version", Organisation: testOrg, Repository: testRepo}
+
+	vc, err := store.CountGroupBy(fq)
+	assert.NoError(t, err)
+	assert.Equal(t, ValueCounts{{Value: "1.1.0", Count: 2}, {Value: "1.0.0", Count: 1}}, vc)
+
+	vdc, err := store.CountByDateGroupBy(fq)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(vdc))
+	assert.Equal(t, "1.0.0", vdc[0].Value)
+	assert.Equal(t, 1, len(vdc[0].Data))
+	assert.EqualValues(t, 1, vdc[0].Data[0].Count)
+	assert.Equal(t, "1.1.0", vdc[1].Value)
+	assert.EqualValues(t, 2, vdc[1].Data[0].Count)
+}
+
+func TestCountCallsWhere(t *testing.T) {
+	testOrg := uuid.NewV1().String()
+	testRepo := uuid.NewV1().String()
+
+	for _, pl := range []string{
+		`{"version": "1.4.0", "duration_ms": 300}`,
+		`{"version": "1.4.0", "duration_ms": 800}`,
+		`{"version": "1.5.0", "duration_ms": 900}`,
+		`{"version": "1.5.0", "duration_ms": "slow"}`,
+		`{"err": "connection refused: db:5432"}`,
+	} {
+		_, err := registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(pl)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type test struct {
+		where       []string
+		expectErr   bool
+		expectedLen int64
+	}
+
+	tests := []test{
+		{where: []string{"version:eq:1.4.0"}, expectedLen: 2},
+		{where: []string{"version:ne:1.4.0"}, expectedLen: 3},
+		{where: []string{"duration_ms:gt:500"}, expectedLen: 2},
+		{where: []string{"duration_ms:lte:800"}, expectedLen: 2},
+		{where: []string{"version:eq:1.4.0", "duration_ms:gt:500"}, expectedLen: 1},
+		{where: []string{"err:eq:connection refused: db:5432"}, expectedLen: 1},
+		{where: []string{"duration_ms:gt:fast"}, expectErr: true},
+		{where: []string{"version:like:1.%"}, expectErr: true},
+	}
+
+	for _, test := range tests {
+		cc, err := store.CountCalls(FilterQuery{Where: test.where, Organisation: testOrg, Repository: testRepo})
+		assert.Equal(t, test.expectErr, err != nil, test.where)
+		assert.Equal(t, test.expectedLen, cc, test.where)
+	}
+}
+
+func TestCountUnique(t *testing.T) {
+	testOrg := uuid.NewV1().String()
+	testRepo := uuid.NewV1().String()
+
+	for _, origin := range []string{"ci", "ci", "ci", "laptop"} {
+		_, err := registerCall(Call{Organisation: testOrg, Repository: testRepo, Origin: origin, Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{}`)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cc, err := store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, cc)
+
+	cc, err = store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo, Unique: true})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, cc)
+
+	dc, err := store.CountByDate(FilterQuery{Organisation: testOrg, Repository: testRepo, Unique: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dc))
+	assert.EqualValues(t, 2, dc[0].Count)
+
+	router := buildServer()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/%s/count/unique", testOrg, testRepo), nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var cs CountResp
+	json.NewDecoder(w.Body).Decode(&cs)
+	assert.Equal(t, 200, w.Result().StatusCode)
+	assert.EqualValues(t, 2, cs.Data)
+}
+
+func TestCountCallsSeries(t *testing.T) {
+	testOrg := uuid.NewV1().String()
+	testRepo := uuid.NewV1().String()
+
+	for i := 0; i < 2; i++ {
+		_, err := registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{}`)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().UTC()
+	from := JsonDate(now.AddDate(0, 0, -2))
+	to := JsonDate(now.AddDate(0, 0, 1))
+
+	sc, err := store.CountSeries(FilterQuery{Organisation: testOrg, Repository: testRepo, TZ: "UTC", FromDate: &from, ToDate: &to})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(sc))
+	assert.EqualValues(t, 0, sc[0].Count)
+	assert.EqualValues(t, 0, sc[1].Count)
+	assert.EqualValues(t, 2, sc[2].Count)
+	assert.Equal(t, now.Format(YYYYMMDDLayout)+"T00:00:00Z", sc[2].Bucket)
+
+	sc, err = store.CountSeries(FilterQuery{Organisation: testOrg, Repository: testRepo, Interval: "month"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(sc))
+	assert.EqualValues(t, 2, sc[0].Count)
+
+	_, err = store.CountSeries(FilterQuery{Organisation: testOrg, Repository: testRepo, Interval: "fortnight"})
+	assert.Error(t, err)
+
+	_, err = store.CountSeries(FilterQuery{Organisation: testOrg, Repository: testRepo, TZ: "Mars/Olympus_Mons"})
+	assert.Error(t, err)
+}
+
+func TestOriginHash(t *testing.T) {
+	now := time.Now()
+
+	previous, err := originHashAt("192.0.2.1", "testorg", "testrepo", now.Add(-originSaltRotation))
+	assert.NoError(t, err)
+
+	h1, err := originHashAt("192.0.2.1", "testorg", "testrepo", now)
+	assert.NoError(t, err)
+	h2, err := originHashAt("192.0.2.1", "testorg", "testrepo", now)
+	assert.NoError(t, err)
+	otherIP, err := originHashAt("192.0.2.2", "testorg", "testrepo", now)
+	assert.NoError(t, err)
+	otherRepo, err := originHashAt("192.0.2.1", "testorg", "otherrepo", now)
+	assert.NoError(t, err)
+
+	assert.Equal(t, h1, h2) // stable within a rotation window
+	assert.NotEqual(t, h1, previous)
+	assert.NotEqual(t, h1, otherIP)
+	assert.NotEqual(t, h1, otherRepo)
+
+	// the salt of the previous window is gone
+	var salts int64
+	db.Model(&OriginSalt{}).Where("valid_from < ?", now.UTC().Truncate(originSaltRotation)).Count(&salts)
+	assert.EqualValues(t, 0, salts)
+}
+
+func TestSpoolOrigin(t *testing.T) {
+	now := time.Now()
+
+	// a server that hasn't reached the database yet has no salt
+	originSaltCache.Lock()
+	originSaltCache.salt = nil
+	originSaltCache.validFrom = time.Time{}
+	originSaltCache.Unlock()
+
+	s1, err := spoolOrigin("192.0.2.1", "testorg", "testrepo", now)
+	assert.NoError(t, err)
+	s2, err := spoolOrigin("192.0.2.1", "testorg", "testrepo", now)
+	assert.NoError(t, err)
+	otherIP, err := spoolOrigin("192.0.2.2", "testorg", "testrepo", now)
+	assert.NoError(t, err)
+	assert.Equal(t, s1, s2)
+	assert.NotEqual(t, s1, otherIP)
+	assert.NotContains(t, s1, "192.0.2.1")
+
+	h, err := originHash("192.0.2.1", "testorg", "testrepo")
+	assert.NoError(t, err)
+	assert.NotEqual(t, h, s1)
+
+	// once the salt is cached spooled calls get the same origin as stored ones
+	s3, err := spoolOrigin("192.0.2.1", "testorg", "testrepo", now)
+	assert.NoError(t, err)
+	assert.Equal(t, h, s3)
+}
+
+func TestClaimRepository(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	// local stand-in for the github api serving the committed .phonehome file
+	var committed string
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != fmt.Sprintf("/repos/%s/%s/contents/.phonehome", testOrg, testRepo) || committed == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, committed)
+	}))
+	defer gh.Close()
+	defer func(u string) { githubAPIURL = u }(githubAPIURL)
+	githubAPIURL = gh.URL
+
+	do := func(method string, path string, token string, body string) (int, ClaimResp) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("/%s/%s%s", testOrg, testRepo, path), bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var cr ClaimResp
+		json.NewDecoder(w.Body).Decode(&cr)
+		return w.Result().StatusCode, cr
+	}
+
+	code, _ := do("POST", "/claim/verify", "", "")
+	assert.Equal(t, http.StatusBadRequest, code) // no claim started
+
+	code, claim := do("POST", "/claim", "", "")
+	assert.Equal(t, 200, code)
+	assert.NotEmpty(t, claim.Token)
+
+	// claiming again doesn't replace the pending token
+	code, again := do("POST", "/claim", "", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, claim.Token, again.Token)
+
+	code, _ = do("POST", "/claim/verify", "", "")
+	assert.Equal(t, http.StatusForbidden, code) // not committed yet
+
+	committed = claim.Token
+	code, verified := do("POST", "/claim/verify", "", "")
+	assert.Equal(t, 200, code)
+	adminToken := verified.Token
+	assert.NotEmpty(t, adminToken)
+
+	code, _ = do("POST", "/claim", "", "")
+	assert.Equal(t, http.StatusConflict, code)
+
+	// without issued tokens the repository stays open
+	code, _ = do("POST", "", "", `{}`)
+	assert.Equal(t, 200, code)
+	code, _ = do("GET", "/count", "", "")
+	assert.Equal(t, 200, code)
+
+	code, _ = do("POST", "/tokens", "", `{"scope": "write"}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, write := do("POST", "/tokens", adminToken, `{"scope": "write"}`)
+	assert.Equal(t, 200, code)
+	code, read := do("POST", "/tokens", adminToken, `{"scope": "read"}`)
+	assert.Equal(t, 200, code)
+
+	code, _ = do("POST", "", "", `{}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do("POST", "", read.Token, `{}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do("POST", "", write.Token, `{}`)
+	assert.Equal(t, 200, code)
+
+	// public repositories stay readable, also with read tokens issued
+	code, _ = do("GET", "/count", "", "")
+	assert.Equal(t, 200, code)
+
+	code, _ = do("PATCH", "/settings", write.Token, `{"visibility": "private"}`)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do("PATCH", "/settings", adminToken, `{"visibility": "secret"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do("PATCH", "/settings", adminToken, `{"visibility": "private"}`)
+	assert.Equal(t, 200, code)
+
+	code, _ = do("GET", "/count", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do("GET", "/count/badge", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do("GET", "/count/badge", read.Token, "")
+	assert.Equal(t, 200, code)
+	code, _ = do("GET", "/count", write.Token, "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do("GET", "/count", read.Token, "")
+	assert.Equal(t, 200, code)
+	code, _ = do("GET", "/count", adminToken, "")
+	assert.Equal(t, 200, code)
+
+	rts, err := getRepoTokens(testOrg, testRepo)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(rts))
+	assert.Equal(t, scopeAdmin, rts[0].Scope)
+
+	code, _ = do("DELETE", fmt.Sprintf("/tokens/%d", rts[0].ID), adminToken, "")
+	assert.Equal(t, http.StatusConflict, code) // last admin token
+
+	code, _ = do("DELETE", fmt.Sprintf("/tokens/%d", rts[2].ID), adminToken, "")
+	assert.Equal(t, 200, code)
+	code, _ = do("GET", "/count", read.Token, "")
+	assert.Equal(t, http.StatusForbidden, code) // revoked
+
+	// keep the badge public while hiding everything else
+	code, _ = do("PATCH", "/settings", adminToken, `{"public_badge": true}`)
+	assert.Equal(t, 200, code)
+	code, _ = do("GET", "/count/badge", "", "")
+	assert.Equal(t, 200, code)
+	code, _ = do("GET", "", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	r, err := getRepository(testOrg, testRepo)
+	assert.NoError(t, err)
+	assert.Equal(t, visibilityPrivate, r.Visibility)
+	assert.True(t, r.PublicBadge)
+}
+
+func TestRateLimit(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	rateLimitOverrides[testOrg+"/"+testRepo] = RateLimits{OriginRPS: 0.001, OriginBurst: 2, RepoRPS: 100, RepoBurst: 100}
+	defer delete(rateLimitOverrides, testOrg+"/"+testRepo)
+
+	post := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s", testOrg, testRepo), bytes.NewBufferString(`{}`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, 200, post().Code)
+	assert.Equal(t, 200, post().Code)
+
+	w := post()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.Greater(t, retryAfter, 0)
+	assert.Equal(t, http.StatusTooManyRequests, post().Code)
+
+	cc, err := store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, cc)
+
+	assert.NoError(t, droppedCalls.flush())
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/%s/count/dropped", testOrg, testRepo), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var dr DroppedCountResp
+	json.NewDecoder(w.Body).Decode(&dr)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 1, len(dr.Data))
+	assert.Equal(t, dropReasonRateLimited, dr.Data[0].Reason)
+	assert.EqualValues(t, 2, dr.Data[0].Count)
+}
+
+func TestRateLimitUnauthorized(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	rateLimitOverrides[testOrg+"/"+testRepo] = RateLimits{OriginRPS: 100, OriginBurst: 100, RepoRPS: 0.001, RepoBurst: 3}
+	defer delete(rateLimitOverrides, testOrg+"/"+testRepo)
+
+	token, _, err := createRepoToken(db, testOrg, testRepo, scopeWrite, "")
+	assert.NoError(t, err)
+
+	post := func(token string) int {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s", testOrg, testRepo), bytes.NewBufferString(`{}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// calls without a valid token don't use up the calls of the repository
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusUnauthorized, post(""))
+		assert.Equal(t, http.StatusForbidden, post("not a token"))
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 200, post(token))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, post(token))
+
+	assert.NoError(t, droppedCalls.flush())
+	dcs, err := getDroppedCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dcs))
+	assert.EqualValues(t, 1, dcs[0].Count)
+}
+
+func TestRateLimitBatch(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	rateLimitOverrides[testOrg+"/"+testRepo] = RateLimits{OriginRPS: 0.001, OriginBurst: 4, RepoRPS: 100, RepoBurst: 100}
+	defer delete(rateLimitOverrides, testOrg+"/"+testRepo)
+
+	post := func(body string) int {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s/batch", testOrg, testRepo), bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// every call of a batch takes a token
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(`[{}, {}, {}, {}, {}]`))
+	assert.Equal(t, 200, post(`[{}, {}]`))
+	assert.Equal(t, http.StatusTooManyRequests, post(`[{}, {}]`))
+
+	cc, err := store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, cc)
+
+	assert.NoError(t, droppedCalls.flush())
+	dcs, err := getDroppedCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dcs))
+	assert.EqualValues(t, 2, dcs[0].Count)
+}
+
+func TestRegisterBatchHTTP(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	post := func(contentType string, body string) (int, BatchResp) {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s/batch", testOrg, testRepo), bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var br BatchResp
+		json.NewDecoder(w.Body).Decode(&br)
+		return w.Code, br
+	}
+
+	happened := time.Now().UTC().AddDate(0, 0, -2)
+	code, br := post("application/json", `[
+		{"version": "1.0.0", "_ts": "`+happened.Format(time.RFC3339)+`"},
+		{"version": "1.0.0", "nested": {"a": 1}},
+		"not an object",
+		{"version": "1.0.0", "_ts": "last tuesday"}
+	]`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 2, br.Accepted)
+	assert.Equal(t, 2, br.Rejected)
+	assert.Equal(t, []string{batchAccepted, batchStripped, batchRejected, batchRejected},
+		[]string{br.Results[0].Status, br.Results[1].Status, br.Results[2].Status, br.Results[3].Status})
+	assert.NotContains(t, string(br.Results[0].Payload), clientTimestampKey)
+	assert.Equal(t, []KeyIssue{{"nested", stripNestedObject}}, br.Results[1].Stripped)
+
+	code, br = post("application/x-ndjson", "{\"version\": \"1.1.0\"}\n{\"version\": \"1.1.0\"}\n")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 2, br.Accepted)
+
+	code, _ = post("application/json", `[{"a": 1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	cc, err := store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, cc)
+
+	// the client timestamp got stored
+	from := JsonDate(happened)
+	to := JsonDate(happened.AddDate(0, 0, 1))
+	cc, err = store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo, TZ: "UTC", TimeField: timeFieldClient, FromDate: &from, ToDate: &to})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, cc)
+	cc, err = store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo, TZ: "UTC", FromDate: &from, ToDate: &to})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, cc)
+}
+
+func TestIngestQueueHTTP(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	primary := store
+	qs := newQueuedStore(primary, 1, ingestReject, 10, time.Hour)
+	store = qs
+	defer func() { store = primary }()
+
+	post := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s", testOrg, testRepo), bytes.NewBufferString(`{"version": "1.0.0"}`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, 200, post().Code)
+
+	// the queue is full until the writer runs
+	w := post()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	go qs.run()
+	assert.NoError(t, qs.close(context.Background()))
+
+	cc, err := primary.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, cc)
+
+	assert.Equal(t, http.StatusServiceUnavailable, post().Code)
+}
+
+func TestIngestQueueBlockedDB(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	primary := store
+	qs := newQueuedStore(primary, 10, ingestReject, 10, time.Hour)
+	store = qs
+	defer func() { store = primary }()
+
+	post := func() int {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s", testOrg, testRepo), bytes.NewBufferString(`{"version": "1.0.0"}`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the settings of the repository are cached by the first call
+	assert.Equal(t, 200, post())
+
+	// a transaction holds the only connection of the test database
+	tx := db.Begin()
+	assert.NoError(t, tx.Error)
+
+	done := make(chan int)
+	go func() { done <- post() }()
+	select {
+	case code := <-done:
+		assert.Equal(t, 200, code)
+	case <-time.After(5 * time.Second):
+		t.Error("registering a call waited for the database")
+	}
+	assert.NoError(t, tx.Rollback().Error)
+
+	go qs.run()
+	assert.NoError(t, qs.close(context.Background()))
+
+	cc, err := primary.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, cc)
+}
+
+func TestSpoolHTTP(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	dir := t.TempDir()
+	sp, err := openSpool(dir, 1<<20, 1<<20)
+	assert.NoError(t, err)
+	callSpool = sp
+	setDBAvailable(false)
+	defer func() {
+		callSpool = nil
+		setDBAvailable(true)
+	}()
+
+	// spooled calls are rate limited per client IP
+	rateLimitOverrides[testOrg+"/"+testRepo] = RateLimits{OriginRPS: 0.001, OriginBurst: 5, RepoRPS: 100, RepoBurst: 100}
+	defer delete(rateLimitOverrides, testOrg+"/"+testRepo)
+
+	// with the salt at hand spooled calls get the same origin as stored ones
+	_, err = originHash("127.0.0.1", testOrg, testRepo)
+	assert.NoError(t, err)
+
+	happened := time.Now().UTC().AddDate(0, 0, -2).Format(time.RFC3339)
+	post := func(path string, body string) int {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s%s", testOrg, testRepo, path), bytes.NewBufferString(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(clientTimestampHeader, happened)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusAccepted, post("/e/install", `{"version": "1.0.0"}`))
+	assert.Equal(t, http.StatusAccepted, post("/batch", `[{"version": "1.0.0"}, {"version": "1.1.0"}]`))
+	assert.Equal(t, http.StatusAccepted, post("", `{"version": {"nested": true}}`))
+	assert.Equal(t, http.StatusAccepted, post("/e/not a valid event", `{}`))
+	assert.Equal(t, http.StatusBadRequest, post("", `{"version": `))
+	assert.Equal(t, http.StatusTooManyRequests, post("", `{}`))
+
+	cc, err := store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, cc)
+
+	// the client IP never reaches the disk
+	segs, err := sp.segments()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, segs)
+	for _, seg := range segs {
+		b, err := os.ReadFile(filepath.Join(dir, seg))
+		assert.NoError(t, err)
+		assert.NotContains(t, string(b), "192.0.2.1")
+	}
+
+	// days aren't rolled up while calls of them are spooled
+	assert.True(t, spoolPending())
+	assert.NoError(t, rollupCompleteDays(time.Now()))
+
+	// the database is back
+	setDBAvailable(true)
+	origin, err := originHash("192.0.2.1", testOrg, testRepo)
+	assert.NoError(t, err)
+	n, err := callSpool.replay(replaySpooled)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.False(t, spoolPending())
+
+	cc, err = store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, cc)
+
+	cc, err = store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo, Event: "install"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, cc)
+
+	calls, _, err := store.ListCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	for _, c := range calls {
+		assert.Equal(t, origin, c.Origin)
+		assert.Equal(t, happened, c.ClientTimestamp.UTC().Format(time.RFC3339))
+	}
+}
+
+func TestClientTimestamp(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	yesterday := time.Now().UTC().AddDate(0, 0, -1)
+
+	post := func(header string, body string) int {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s", testOrg, testRepo), bytes.NewBufferString(body))
+		if header != "" {
+			req.Header.Set(clientTimestampHeader, header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, post("", fmt.Sprintf(`{"_ts": %d}`, yesterday.Unix())))
+	assert.Equal(t, 200, post(yesterday.Format(time.RFC3339), `{}`))
+	assert.Equal(t, 200, post("", `{}`))
+	assert.Equal(t, http.StatusBadRequest, post("soon", `{}`))
+	assert.Equal(t, http.StatusBadRequest, post("", `{"_ts": "soon"}`))
+
+	cs, _, err := store.ListCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(cs))
+	assert.NotNil(t, cs[0].ClientTimestamp)
+	assert.NotContains(t, string(cs[0].Payload.RawMessage), clientTimestampKey)
+	assert.NotNil(t, cs[1].ClientTimestamp)
+	assert.Nil(t, cs[2].ClientTimestamp)
+
+	// bucketing on client time falls back to the receive time
+	dc, err := store.CountByDate(FilterQuery{Organisation: testOrg, Repository: testRepo, TZ: "UTC", TimeField: timeFieldClient})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(dc))
+	assert.EqualValues(t, 2, dc[0].Count)
+	assert.EqualValues(t, 1, dc[1].Count)
+
+	dc, err = store.CountByDate(FilterQuery{Organisation: testOrg, Repository: testRepo, TZ: "UTC"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dc))
+
+	_, err = store.CountByDate(FilterQuery{Organisation: testOrg, Repository: testRepo, TimeField: "sundial"})
+	assert.Error(t, err)
+}
+
+func TestEvents(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	post := func(path string, body string) int {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s%s", testOrg, testRepo, path), bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, 200, post("/e/install", `{"version": "1.0.0"}`))
+	assert.Equal(t, 200, post("/e/command_run", `{"cmd": "init"}`))
+	assert.Equal(t, 200, post("/e/command_run", `{"cmd": "apply"}`))
+	assert.Equal(t, 200, post("/e/crash/batch", `[{"err": "oops"}, {"err": "oops"}, {"err": "boom"}]`))
+	assert.Equal(t, 200, post("", `{}`))
+	assert.Equal(t, http.StatusBadRequest, post("/e/bad!name", `{}`))
+
+	cc, err := store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo, Event: "command_run"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, cc)
+
+	cc, err = store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo, Event: "crash", Where: []string{"err:eq:oops"}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, cc)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/%s/count/events", testOrg, testRepo), nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var gr GroupedCountResp
+	json.NewDecoder(w.Body).Decode(&gr)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, ValueCounts{
+		{Value: "crash", Count: 3},
+		{Value: "command_run", Count: 2},
+		{Value: "", Count: 1},
+		{Value: "install", Count: 1},
+	}, gr.Data)
+}
+
+func TestPayloadSchema(t *testing.T) {
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+	call := func(payload string) Call {
+		return Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(payload)}}
+	}
+
+	schema := PayloadSchema{Mode: schemaModeReport, Keys: map[string]SchemaKey{
+		"version": {Type: schemaTypeString, Required: true},
+		"os":      {Type: schemaTypeString, Enum: []interface{}{"linux", "darwin", "windows"}},
+	}}
+	assert.Error(t, putPayloadSchema(testOrg, testRepo, PayloadSchema{Mode: "ignore", Keys: schema.Keys}))
+	assert.NoError(t, putPayloadSchema(testOrg, testRepo, schema))
+
+	// report mode registers the call anyway
+	_, err := registerCall(call(`{"version": "1.0.0", "os": "linux"}`))
+	assert.NoError(t, err)
+	_, err = registerCall(call(`{"verison": "1.0.0", "os": "plan9"}`))
+	assert.NoError(t, err)
+
+	schema.Mode = schemaModeReject
+	assert.NoError(t, putPayloadSchema(testOrg, testRepo, schema))
+	_, err = registerCall(call(`{"verison": "1.0.0"}`))
+	assert.Error(t, err)
+
+	cc, err := store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, cc)
+
+	assert.NoError(t, schemaViolations.flush())
+	svs, err := getSchemaViolations(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+
+	counts := map[KeyIssue]int64{}
+	for _, sv := range svs {
+		counts[KeyIssue{sv.Key, sv.Reason}] += sv.Count
+	}
+	assert.Equal(t, map[KeyIssue]int64{
+		{"os", violationNotInEnum}:       1,
+		{"verison", violationUnknownKey}: 2,
+		{"version", violationMissing}:    2,
+	}, counts)
+
+	deleted, err := deletePayloadSchema(testOrg, testRepo)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, err = registerCall(call(`{"verison": "1.0.0"}`))
+	assert.NoError(t, err)
+}
+
+func TestPayloadLimitsHTTP(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	req, _ := http.NewRequest("GET", "/info", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var ir InfoResp
+	json.NewDecoder(w.Body).Decode(&ir)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, payloadLimits, ir.Limits)
+
+	post := func(body string) int {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s", testOrg, testRepo), bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tooManyKeys := map[string]int{}
+	for i := 0; i <= payloadLimits.MaxKeys; i++ {
+		tooManyKeys[fmt.Sprintf("k%d", i)] = i
+	}
+	b, _ := json.Marshal(tooManyKeys)
+
+	assert.Equal(t, 200, post(`{"version": "1.0.0"}`))
+	assert.Equal(t, http.StatusBadRequest, post(string(b)))
+	assert.Equal(t, http.StatusBadRequest, post(`{"err": "`+strings.Repeat("x", payloadLimits.MaxValueLength+1)+`"}`))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(`{"err": "`+strings.Repeat("x", payloadLimits.MaxBytes)+`"}`))
+}
+
+func TestScrubbing(t *testing.T) {
+	router := buildServer()
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	post := func(body string) RegisterResp {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/%s/%s", testOrg, testRepo), bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var rr RegisterResp
+		json.NewDecoder(w.Body).Decode(&rr)
+		assert.Equal(t, 200, w.Code)
+		return rr
+	}
+
+	rr := post(`{"err": "can't read /home/jane/.tool.yaml", "user": "jane@example.com"}`)
+	assert.Equal(t, 2, rr.Redactions)
+	assert.JSONEq(t, `{"err": "can't read /home/[user]/.tool.yaml", "user": "[email]"}`, string(rr.Payload))
+
+	assert.NoError(t, putScrubConfig(testOrg, testRepo, ScrubConfig{
+		Detectors: &[]string{detectorHomePath},
+		Rules:     []ScrubRule{{Name: "ticket", Pattern: `JIRA-[0-9]+`, Replacement: "JIRA-?"}},
+	}))
+	assert.Error(t, putScrubConfig(testOrg, testRepo, ScrubConfig{Detectors: &[]string{"phone"}}))
+
+	rr = post(`{"err": "see JIRA-42", "user": "jane@example.com"}`)
+	assert.Equal(t, 1, rr.Redactions)
+
+	cs, _, err := store.ListCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.Len(t, cs, 2)
+	for _, c := range cs {
+		// what is stored is what was returned
+		assert.NotContains(t, string(c.Payload.RawMessage), "/home/jane")
+		assert.NotContains(t, string(c.Payload.RawMessage), "JIRA-42")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	requirePostgres(t)
+
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+	testRepoNoRollup := uuid.NewV4().String()
+
+	loc, err := filterLocation(FilterQuery{})
+	assert.NoError(t, err)
+	now := time.Now().In(loc)
+	old := now.AddDate(0, 0, -100)
+
+	for _, repo := range []string{testRepo, testRepoNoRollup} {
+		for _, c := range []Call{
+			{Timestamp: old, Event: "install", Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{"version": "1.0.0"}`)}},
+			{Timestamp: old, Event: "crash", Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{"err": "oops"}`)}},
+			{Timestamp: old.AddDate(0, 0, 1), Event: "install", Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{"version": "1.0.0"}`)}},
+			{Timestamp: now, Event: "install", Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{"version": "1.1.0"}`)}},
+		} {
+			c.Organisation = testOrg
+			c.Repository = repo
+			_, err := registerCall(c)
+			assert.NoError(t, err)
+		}
+	}
+
+	days := 90
+	rollup := false
+	assert.NoError(t, db.Create(&Repository{Organisation: testOrg, Repository: testRepo, RetentionDays: &days}).Error)
+	assert.NoError(t, db.Create(&Repository{Organisation: testOrg, Repository: testRepoNoRollup, RetentionDays: &days, RollupExpired: &rollup}).Error)
+	assert.NoError(t, purgeExpiredCalls(time.Now()))
+
+	for _, repo := range []string{testRepo, testRepoNoRollup} {
+		var raw int64
+		assert.NoError(t, db.Model(&Call{}).Where("organisation = ? AND repository = ?", testOrg, repo).Count(&raw).Error)
+		assert.EqualValues(t, 1, raw)
+	}
+
+	// expired calls are still counted from the rollups
+	type test struct {
+		fq   FilterQuery
+		want int64
+	}
+
+	tests := []test{
+		{FilterQuery{}, 4},
+		{FilterQuery{Event: "install"}, 3},
+		{FilterQuery{Key: "version"}, 3},
+		{FilterQuery{Key: "err", Event: "install"}, 0},
+		{FilterQuery{Unique: true}, 3},
+		{FilterQuery{Where: []string{"version:eq:1.0.0"}}, 0},
+	}
+
+	for _, tc := range tests {
+		tc.fq.Organisation = testOrg
+		tc.fq.Repository = testRepo
+		cc, err := store.CountCalls(tc.fq)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, cc, tc.fq)
+	}
+
+	dc, err := store.CountByDate(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.Equal(t, DayCounts{
+		{Date: old.Format(YYYYMMDDLayout), Count: 2},
+		{Date: old.AddDate(0, 0, 1).Format(YYYYMMDDLayout), Count: 1},
+		{Date: now.Format(YYYYMMDDLayout), Count: 1},
+	}, dc)
+
+	sc, err := store.CountSeries(FilterQuery{Organisation: testOrg, Repository: testRepo, Interval: "month"})
+	assert.NoError(t, err)
+	var total int64
+	for _, s := range sc {
+		total += s.Count
+	}
+	assert.EqualValues(t, 4, total)
+
+	// without rollups expired calls are gone
+	cc, err := store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepoNoRollup})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, cc)
+}
+
+func TestRollup(t *testing.T) {
+	requirePostgres(t)
+
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	loc, err := filterLocation(FilterQuery{})
+	assert.NoError(t, err)
+	now := time.Now().In(loc)
+
+	for _, c := range []Call{
+		{Timestamp: now.AddDate(0, 0, -2), Event: "install", Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{"version": "1.0.0"}`)}},
+		{Timestamp: now.AddDate(0, 0, -1), Event: "install", Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{"version": "1.0.0"}`)}},
+		{Timestamp: now.AddDate(0, 0, -1), Event: "crash", Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{"err": "oops"}`)}},
+		{Timestamp: now, Event: "crash", Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{"err": "oops"}`)}},
+	} {
+		c.Organisation = testOrg
+		c.Repository = testRepo
+		_, err := registerCall(c)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, rollupCompleteDays(time.Now()))
+	wm, err := getRollupWatermark(testOrg, testRepo)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Format(YYYYMMDDLayout), wm)
+
+	// rolling up again changes nothing
+	assert.NoError(t, rollupCompleteDays(time.Now()))
+	var rollups int64
+	assert.NoError(t, db.Model(&CallRollup{}).Where("organisation = ? AND repository = ? AND event = ? AND key = ''", testOrg, testRepo, rollupAllEvents).Count(&rollups).Error)
+	assert.EqualValues(t, 2, rollups)
+
+	// the counts of complete days now come from the rollups only
+	todayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	assert.NoError(t, db.Where("organisation = ? AND repository = ? AND timestamp < ?", testOrg, testRepo, todayStart).Delete(&Call{}).Error)
+
+	cc, err := store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, cc)
+
+	cc, err = store.CountCalls(FilterQuery{Organisation: testOrg, Repository: testRepo, Key: "err"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, cc)
+
+	vc, err := store.CountByEvent(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.Equal(t, ValueCounts{{Value: "crash", Count: 2}, {Value: "install", Count: 2}}, vc)
+
+	dc, err := store.CountByDate(FilterQuery{Organisation: testOrg, Repository: testRepo, Event: "install"})
+	assert.NoError(t, err)
+	assert.Equal(t, DayCounts{
+		{Date: now.AddDate(0, 0, -2).Format(YYYYMMDDLayout), Count: 1},
+		{Date: now.AddDate(0, 0, -1).Format(YYYYMMDDLayout), Count: 1},
+	}, dc)
+}
+
+func TestStoredPayloadIsSanitized(t *testing.T) {
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	cr, err := registerCall(Call{Organisation: testOrg, Repository: testRepo,
+		Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{"version": "1.0.0", "nested": {"a": 1}, "list": [{"b": 2}]}`)}})
+	assert.NoError(t, err)
+	assert.Len(t, cr.stripped, 2)
+
+	calls, _, err := store.ListCalls(FilterQuery{Organisation: testOrg, Repository: testRepo})
+	assert.NoError(t, err)
+	assert.Len(t, calls, 1)
+	assert.JSONEq(t, `{"version": "1.0.0"}`, string(calls[0].Payload.RawMessage))
+}
+
+func TestCallAttributes(t *testing.T) {
+	requirePostgres(t)
+
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	// one call from before attributes were used
+	_, err := registerCall(Call{Organisation: testOrg, Repository: testRepo,
+		Payload: postgres.Jsonb{RawMessage: json.RawMessage(`{"version": "1.0.0", "took": 3}`)}})
+	assert.NoError(t, err)
+
+	useCallAttributes = true
+	defer func() { useCallAttributes = false }()
+
+	for _, pl := range []string{`{"version": "1.0.0", "took": 10}`, `{"version": "2.0.0", "took": null}`, `{"other": true}`} {
+		_, err := registerCall(Call{Organisation: testOrg, Repository: testRepo, Payload: postgres.Jsonb{RawMessage: json.RawMessage(pl)}})
+		assert.NoError(t, err)
+	}
+
+	_, err = backfillCallAttributes(100)
+	assert.NoError(t, err)
+
+	type test struct {
+		fq    FilterQuery
+		count int64
+	}
+
+	tests := []test{
+		{FilterQuery{Key: "version"}, 3},
+		{FilterQuery{Where: []string{"version:eq:1.0.0"}}, 2},
+		{FilterQuery{Where: []string{"version:ne:1.0.0"}}, 2},
+		{FilterQuery{Where: []string{"took:gt:5"}}, 1},
+		{FilterQuery{Where: []string{"took:lte:10"}}, 2},
+		{FilterQuery{Where: []string{"other:eq:true"}}, 1},
+	}
+
+	for _, tc := range tests {
+		tc.fq.Organisation = testOrg
+		tc.fq.Repository = testRepo
+		cc, err := store.CountCalls(tc.fq)
+		assert.NoError(t, err)
+		assert.EqualValues(t, tc.count, cc, tc.fq)
+	}
+
+	vc, err := store.CountGroupBy(FilterQuery{Organisation: testOrg, Repository: testRepo, GroupBy: "version"})
+	assert.NoError(t, err)
+	assert.Equal(t, ValueCounts{{Value: "1.0.0", Count: 2}, {Value: "2.0.0", Count: 1}}, vc)
+
+	// the same counts come from the payloads
+	useCallAttributes = false
+	vc, err = store.CountGroupBy(FilterQuery{Organisation: testOrg, Repository: testRepo, GroupBy: "version"})
+	assert.NoError(t, err)
+	assert.Equal(t, ValueCounts{{Value: "1.0.0", Count: 2}, {Value: "2.0.0", Count: 1}}, vc)
+}
+
+func TestMigrations(t *testing.T) {
+	requirePostgres(t)
+
+	last := migrations[len(migrations)-1]
+
+	states, err := migrationStatus()
+	assert.NoError(t, err)
+	assert.Len(t, states, len(migrations))
+	for _, ms := range states {
+		assert.NotNil(t, ms.appliedAt, ms.name)
+	}
+
+	done, err := migrateDown(1)
+	assert.NoError(t, err)
+	assert.Len(t, done, 1)
+	assert.Equal(t, last.version, done[0].version)
+
+	states, err = migrationStatus()
+	assert.NoError(t, err)
+	assert.Nil(t, states[len(states)-1].appliedAt)
+
+	done, err = migrateUp(0)
+	assert.NoError(t, err)
+	assert.Len(t, done, 1)
+	assert.Equal(t, last.version, done[0].version)
+
+	// nothing left to apply
+	done, err = migrateUp(0)
+	assert.NoError(t, err)
+	assert.Empty(t, done)
+}
+
+// TestClickHouse checks that ClickHouse counts like the primary store does,
+// against the server at CLICKHOUSE_URL.
+func TestClickHouse(t *testing.T) {
+	if os.Getenv("CLICKHOUSE_URL") == "" {
+		t.Skip("needs a clickhouse server, set CLICKHOUSE_URL")
+	}
+
+	testOrg := uuid.NewV4().String()
+	testRepo := uuid.NewV4().String()
+
+	ch := newClickHouse()
+	assert.NoError(t, ch.createTable())
+	sink := newClickHouseSink(ch)
+
+	primary := store
+	store = analyticsStore{Store: primary, sink: sink, queries: true}
+	defer func() { store = primary }()
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	for i, pl := range []string{
+		`{"version": "1.4.0", "duration_ms": 300, "os": "linux"}`,
+		`{"version": "1.4.0", "duration_ms": 800, "os": null}`,
+		`{"version": "1.5.0", "duration_ms": 900, "os": "darwin"}`,
+		`{"version": "1.5.0", "duration_ms": "slow", "ok": true}`,
+		`{"err": "connection refused: db:5432"}`,
+	} {
+		c := Call{Organisation: testOrg, Repository: testRepo, Origin: strconv.Itoa(i % 2), Event: []string{"run", "install"}[i%2],
+			Payload: postgres.Jsonb{RawMessage: json.RawMessage(pl)}}
+		if i%2 == 0 {
+			c.ClientTimestamp = &yesterday
+		}
+		if _, err := registerCall(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NoError(t, sink.flush())
+
+	from := JsonDate(time.Now().AddDate(0, 0, -3))
+	to := JsonDate(time.Now().AddDate(0, 0, 1))
+	for _, fq := range []FilterQuery{
+		{},
+		{Unique: true},
+		{Event: "run"},
+		{Key: "os"},
+		{Where: []string{"version:eq:1.4.0"}},
+		{Where: []string{"version:ne:1.4.0"}},
+		{Where: []string{"duration_ms:gt:500"}},
+		{Where: []string{"ok:eq:true", "duration_ms:lte:800"}},
+		{TimeField: timeFieldClient, TZ: "America/New_York", FromDate: &from, ToDate: &to},
+		{GroupBy: "os"},
+		{GroupBy: "version", Unique: true},
+		{Interval: "hour"},
+		{Interval: "week", TZ: "Asia/Tokyo"},
+		{Interval: "month", FromDate: &from},
+	} {
+		fq.Organisation, fq.Repository = testOrg, testRepo
+
+		for name, count := range map[string]func(Store) (interface{}, error){
+			"calls":  func(s Store) (interface{}, error) { return s.CountCalls(fq) },
+			"date":   func(s Store) (interface{}, error) { return s.CountByDate(fq) },
+			"series": func(s Store) (interface{}, error) { return s.CountSeries(fq) },
+			"event":  func(s Store) (interface{}, error) { return s.CountByEvent(fq) },
+			"group": func(s Store) (interface{}, error) {
+				if fq.GroupBy == "" {
+					return nil, nil
+				}
+				return s.CountGroupBy(fq)
+			},
+			"dategroup": func(s Store) (interface{}, error) {
+				if fq.GroupBy == "" {
+					return nil, nil
+				}
+				return s.CountByDateGroupBy(fq)
+			},
+		} {
+			expected, err := count(primary)
+			assert.NoError(t, err, name, fq)
+			actual, err := count(store)
+			assert.NoError(t, err, name, fq)
+			assert.Equal(t, expected, actual, name, fq)
+		}
+	}
+}
+
 func TestGetOrgRepoHTTP(t *testing.T) {
 	router := buildServer()
 
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/go-sqlite"
+	"github.com/jackc/pgconn"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	ingestBlock      = "block"
+	ingestDropOldest = "drop_oldest"
+	ingestReject     = "reject"
+
+	dropReasonQueueFull   = "queue_full"
+	dropReasonWriteFailed = "write_failed"
+
+	// SQLite result codes of errors that can go away
+	sqliteBusy   = 5
+	sqliteLocked = 6
+	sqliteIOErr  = 10
+	sqliteFull   = 13
+)
+
+var (
+	errIngestQueueFull = errors.New("too many calls are waiting to be stored, try again later")
+	errIngestClosed    = errors.New("the server is shutting down")
+)
+
+// ingestErrorStatus is the status of a failed registration, 503 with a
+// Retry-After header when the calls weren't queued, status otherwise.
+func ingestErrorStatus(c *gin.Context, err error, status int) int {
+	if errors.Is(err, errIngestQueueFull) || errors.Is(err, errIngestClosed) {
+		c.Header("Retry-After", "1")
+		return http.StatusServiceUnavailable
+	}
+	return status
+}
+
+// queuedStore puts registered calls in a bounded queue and stores them in
+// the background, so that registering a call doesn't wait for the database.
+// Calls are stored in batches of INGEST_FLUSH_ROWS calls, or of whatever
+// arrived within INGEST_FLUSH_INTERVAL. INGEST_BACKPRESSURE decides what
+// happens when the queue is full: block until there is room, drop the
+// oldest queued calls or reject the new ones.
+type queuedStore struct {
+	Store
+	queue        chan Call
+	backpressure string
+	flushRows    int
+	interval     time.Duration
+	attempts     int
+
+	// send keeps producers from interleaving when they need room in the
+	// queue, closing keeps them from sending on a closed queue
+	send    sync.Mutex
+	closing sync.RWMutex
+	closed  bool
+	done    chan struct{}
+
+	// pending counts the calls that are queued or being written, oldest is
+	// the receive time of the first call of the batch that is being built or
+	// written, see pendingSince
+	pendingMu sync.Mutex
+	pending   int
+	oldest    time.Time
+}
+
+// initIngestQueue puts a queuedStore in front of the store when INGEST_ASYNC
+// is set and starts its writer.
+func initIngestQueue() (*queuedStore, error) {
+	if !viper.GetBool("INGEST_ASYNC") {
+		return nil, nil
+	}
+
+	switch viper.GetString("INGEST_BACKPRESSURE") {
+	case ingestBlock, ingestDropOldest, ingestReject:
+	default:
+		return nil, fmt.Errorf("unknown backpressure '%s', expected one of %s, %s or %s",
+			viper.GetString("INGEST_BACKPRESSURE"), ingestBlock, ingestDropOldest, ingestReject)
+	}
+
+	qs := newQueuedStore(store, viper.GetInt("INGEST_QUEUE_SIZE"), viper.GetString("INGEST_BACKPRESSURE"),
+		viper.GetInt("INGEST_FLUSH_ROWS"), viper.GetDuration("INGEST_FLUSH_INTERVAL"))
+	qs.attempts = viper.GetInt("INGEST_WRITE_ATTEMPTS")
+	go qs.run()
+
+	store = qs
+	return qs, nil
+}
+
+func newQueuedStore(s Store, size int, backpressure string, flushRows int, interval time.Duration) *queuedStore {
+	return &queuedStore{
+		Store:        s,
+		queue:        make(chan Call, size),
+		backpressure: backpressure,
+		flushRows:    flushRows,
+		interval:     interval,
+		attempts:     1,
+		done:         make(chan struct{}),
+	}
+}
+
+// RegisterCalls queues calls, the calls of a batch are all queued or all
+// rejected.
+func (qs *queuedStore) RegisterCalls(calls []Call) error {
+	qs.closing.RLock()
+	defer qs.closing.RUnlock()
+	if qs.closed {
+		return errIngestClosed
+	}
+
+	switch qs.backpressure {
+	case ingestReject:
+		qs.send.Lock()
+		defer qs.send.Unlock()
+
+		if cap(qs.queue)-len(qs.queue) < len(calls) {
+			for _, c := range calls {
+				droppedCalls.add(c.Organisation, c.Repository, dropReasonQueueFull, "", 1)
+			}
+			return errIngestQueueFull
+		}
+		qs.addPending(len(calls))
+		for _, c := range calls {
+			qs.queue <- c
+		}
+
+	case ingestDropOldest:
+		qs.send.Lock()
+		defer qs.send.Unlock()
+
+		qs.addPending(len(calls))
+		for _, c := range calls {
+			for sent := false; !sent; {
+				select {
+				case qs.queue <- c:
+					sent = true
+				default:
+					select {
+					case old := <-qs.queue:
+						qs.addPending(-1)
+						droppedCalls.add(old.Organisation, old.Repository, dropReasonQueueFull, "", 1)
+					default:
+					}
+				}
+			}
+		}
+
+	default:
+		qs.addPending(len(calls))
+		for _, c := range calls {
+			qs.queue <- c
+		}
+	}
+
+	return nil
+}
+
+// run stores the queued calls until the queue is closed and drained.
+func (qs *queuedStore) run() {
+	defer close(qs.done)
+
+	tick := time.NewTicker(qs.interval)
+	defer tick.Stop()
+
+	var batch []Call
+	for {
+		select {
+		case c, ok := <-qs.queue:
+			if !ok {
+				qs.write(batch)
+				return
+			}
+			if len(batch) == 0 {
+				qs.pendingMu.Lock()
+				qs.oldest = c.Timestamp
+				qs.pendingMu.Unlock()
+			}
+			batch = append(batch, c)
+			if len(batch) < qs.flushRows {
+				continue
+			}
+		case <-tick.C:
+		}
+
+		qs.write(batch)
+		batch = nil
+	}
+}
+
+// write stores a batch of queued calls, see writeCalls.
+func (qs *queuedStore) write(calls []Call) {
+	writeCalls(qs.Store, calls, qs.attempts)
+	qs.addPending(-len(calls))
+}
+
+func (qs *queuedStore) addPending(n int) {
+	qs.pendingMu.Lock()
+	defer qs.pendingMu.Unlock()
+	qs.pending += n
+}
+
+// pendingSince returns the receive time of the oldest call that isn't stored
+// yet, false when all calls are stored. Calls are written in the order they
+// were queued, so calls that are still queued were received after the first
+// call of the last batch, give or take the time it takes to queue a call.
+func (qs *queuedStore) pendingSince() (time.Time, bool) {
+	qs.pendingMu.Lock()
+	defer qs.pendingMu.Unlock()
+
+	if qs.pending <= 0 {
+		return time.Time{}, false
+	}
+	return qs.oldest, true
+}
+
+// ingestPendingSince is pendingSince of the ingest queue, false without one.
+func ingestPendingSince() (time.Time, bool) {
+	qs, ok := store.(*queuedStore)
+	if !ok {
+		return time.Time{}, false
+	}
+	return qs.pendingSince()
+}
+
+// writeCalls stores calls in s in a single multi-row insert. Errors that
+// might go away are retried up to attempts times with a growing pause in
+// between, after that the calls are counted as dropped. Other errors are
+// caused by the calls themselves, the batch is then split in halves until
+// only the calls that can't be stored are left, and these are dropped.
+func writeCalls(s Store, calls []Call, attempts int) {
+	if len(calls) == 0 {
+		return
+	}
+
+	pause := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := s.RegisterCalls(calls)
+		// calls that didn't fit in the spool are counted as dropped already
+		if err == nil || errors.Is(err, errSpoolFull) {
+			return
+		}
+
+		if !transientError(err) {
+			if len(calls) > 1 {
+				writeCalls(s, calls[:len(calls)/2], attempts)
+				writeCalls(s, calls[len(calls)/2:], attempts)
+				return
+			}
+			log.Error().Err(err).Msgf("can't store a call of %s/%s, dropping it", calls[0].Organisation, calls[0].Repository)
+			droppedCalls.add(calls[0].Organisation, calls[0].Repository, dropReasonWriteFailed, "", 1)
+			return
+		}
+
+		if attempt >= attempts {
+			log.Error().Err(err).Msgf("can't store %d calls, dropping them", len(calls))
+			for _, c := range calls {
+				droppedCalls.add(c.Organisation, c.Repository, dropReasonWriteFailed, "", 1)
+			}
+			return
+		}
+
+		log.Warn().Err(err).Msgf("can't store %d calls, retrying in %s", len(calls), pause)
+		time.Sleep(pause)
+		pause *= 2
+	}
+}
+
+// transientError reports whether a write that failed with err might succeed
+// when it is tried again: when the connection to the database failed, or when
+// the database was busy or out of resources. Other errors are about the data,
+// or unknown, and are not retried.
+func transientError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code[:2] {
+		// connection exception, transaction rollback, insufficient resources,
+		// operator intervention and system error
+		case "08", "40", "53", "57", "58":
+			return true
+		}
+		return false
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		// the primary result code is in the lowest byte
+		switch sqliteErr.Code() & 0xff {
+		case sqliteBusy, sqliteLocked, sqliteIOErr, sqliteFull:
+			return true
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) || pgconn.Timeout(err)
+}
+
+// close stops taking calls and waits until the queued ones are stored, or
+// until ctx is done.
+func (qs *queuedStore) close(ctx context.Context) error {
+	qs.closing.Lock()
+	if !qs.closed {
+		qs.closed = true
+		close(qs.queue)
+	}
+	qs.closing.Unlock()
+
+	select {
+	case <-qs.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d queued calls were not stored: %w", len(qs.queue), ctx.Err())
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// PayloadLimits are the limits calls have to stay within. A limit of zero
+// or less is not enforced.
+type PayloadLimits struct {
+	MaxBytes       int `json:"max_bytes"`
+	MaxKeys        int `json:"max_keys"`
+	MaxKeyLength   int `json:"max_key_length"`
+	MaxValueLength int `json:"max_value_length"`
+	MaxArrayLength int `json:"max_array_length"`
+	MaxBatchItems  int `json:"max_batch_items"`
+	MaxBatchBytes  int `json:"max_batch_bytes"`
+}
+
+var (
+	errPayloadTooLarge = errors.New("payload too large")
+
+	payloadLimits = PayloadLimits{
+		MaxBytes:       8 * 1024,
+		MaxKeys:        64,
+		MaxKeyLength:   64,
+		MaxValueLength: 1024,
+		MaxArrayLength: 10,
+		MaxBatchItems:  1000,
+		MaxBatchBytes:  1024 * 1024,
+	}
+)
+
+func setPayloadLimitDefaults() {
+	viper.SetDefault("PAYLOAD_MAX_BYTES", payloadLimits.MaxBytes)
+	viper.SetDefault("PAYLOAD_MAX_KEYS", payloadLimits.MaxKeys)
+	viper.SetDefault("PAYLOAD_MAX_KEY_LENGTH", payloadLimits.MaxKeyLength)
+	viper.SetDefault("PAYLOAD_MAX_VALUE_LENGTH", payloadLimits.MaxValueLength)
+	viper.SetDefault("PAYLOAD_MAX_ARRAY_LEN", payloadLimits.MaxArrayLength)
+	viper.SetDefault("BATCH_MAX_ITEMS", payloadLimits.MaxBatchItems)
+	viper.SetDefault("BATCH_MAX_BYTES", payloadLimits.MaxBatchBytes)
+}
+
+func loadPayloadLimits() {
+	payloadLimits = PayloadLimits{
+		MaxBytes:       viper.GetInt("PAYLOAD_MAX_BYTES"),
+		MaxKeys:        viper.GetInt("PAYLOAD_MAX_KEYS"),
+		MaxKeyLength:   viper.GetInt("PAYLOAD_MAX_KEY_LENGTH"),
+		MaxValueLength: viper.GetInt("PAYLOAD_MAX_VALUE_LENGTH"),
+		MaxArrayLength: viper.GetInt("PAYLOAD_MAX_ARRAY_LEN"),
+		MaxBatchItems:  viper.GetInt("BATCH_MAX_ITEMS"),
+		MaxBatchBytes:  viper.GetInt("BATCH_MAX_BYTES"),
+	}
+}
+
+// readBody reads the request body, but stops with errPayloadTooLarge as soon
+// as it grows beyond max bytes.
+func readBody(c *gin.Context, max int) ([]byte, error) {
+	r := io.Reader(c.Request.Body)
+	if max > 0 {
+		r = io.LimitReader(r, int64(max)+1)
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && len(b) > max {
+		return nil, fmt.Errorf("%w, the maximum is %d bytes", errPayloadTooLarge, max)
+	}
+	return b, nil
+}
+
+func bodyErrorStatus(err error) int {
+	if errors.Is(err, errPayloadTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// checkPayloadLimits walks the tokens of a raw payload, so that it can be
+// refused before unmarshalling it. Keys are only counted at the top level,
+// key and string lengths are checked at any depth.
+func checkPayloadLimits(raw []byte, limits PayloadLimits) error {
+	if limits.MaxBytes > 0 && len(raw) > limits.MaxBytes {
+		return fmt.Errorf("%w, the maximum is %d bytes", errPayloadTooLarge, limits.MaxBytes)
+	}
+
+	type level struct {
+		object  bool
+		wantKey bool
+	}
+
+	var levels []level
+	var keys int
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			levels = levels[:len(levels)-1]
+			continue
+		}
+
+		// inside objects keys and values alternate
+		top := len(levels) - 1
+		isKey := top >= 0 && levels[top].object && levels[top].wantKey
+		if top >= 0 && levels[top].object {
+			levels[top].wantKey = !isKey
+		}
+
+		switch v := tok.(type) {
+		case json.Delim:
+			levels = append(levels, level{object: v == '{', wantKey: true})
+		case string:
+			n := utf8.RuneCountInString(v)
+			switch {
+			case isKey && limits.MaxKeyLength > 0 && n > limits.MaxKeyLength:
+				return fmt.Errorf("key '%.16s...' is longer than %d characters", v, limits.MaxKeyLength)
+			case !isKey && limits.MaxValueLength > 0 && n > limits.MaxValueLength:
+				return fmt.Errorf("a value is longer than %d characters", limits.MaxValueLength)
+			}
+
+			if isKey && top == 0 {
+				keys++
+				if limits.MaxKeys > 0 && keys > limits.MaxKeys {
+					return fmt.Errorf("payload has more than %d keys", limits.MaxKeys)
+				}
+			}
+		}
+	}
+}
+
+// @Summary      Get server info.
+// @Description  Get the limits calls have to stay within, so clients can check them before sending.
+// @Description  Limits of zero are not enforced.
+// @Produce      json
+// @Success      200  {object}  InfoResp
+// @Router       /info [get]
+func infoHandler(c *gin.Context) {
+	resp := InfoResp{Limits: payloadLimits}
+	c.JSON(200, resp)
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -19,12 +25,89 @@ import (
 
 // @host  api.phonehome.dev
 
-// @securityDefinitions.basic  BasicAuth
+// @securityDefinitions.apikey  BearerAuth
+// @in                          header
+// @name                        Authorization
 func main() {
 	InitConfig()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if viper.GetString("STORE") != storePostgres {
+			log.Fatal().Msg("only the postgres store has migrations")
+		}
+		// migrations run from the command only
+		viper.Set("MIGRATE_ON_START", false)
+		if err := InitDBConn(); err != nil {
+			log.Fatal().Err(err).Msg("cannot connect to db")
+		}
+		os.Exit(migrateCommand(os.Args[2:]))
+	}
+
+	// without a database calls are spooled until it shows up
+	var setUp func() error
 	if err := InitDBConn(); err != nil {
-		log.Fatal().Err(err).Msg("cannot connect to db")
+		if viper.GetString("SPOOL_DIR") == "" || viper.GetString("STORE") != storePostgres || pingDB() == nil {
+			log.Fatal().Err(err).Msg("cannot connect to db")
+		}
+		log.Warn().Err(err).Msg("cannot connect to db, starting in ingest-only mode")
+		setDBAvailable(false)
+		setUp = setUpPostgres
+	}
+	sink, err := initAnalytics()
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot set up the analytics sink")
+	}
+	if err := initSpool(); err != nil {
+		log.Fatal().Err(err).Msg("cannot open the spool")
+	}
+	queue, err := initIngestQueue()
+	if err != nil {
+		log.Fatal().Err(err).Msg("cannot set up the ingest queue")
+	}
+	go runTallyFlusher(10 * time.Second)
+	go runRateLimitJobs(time.Minute)
+	if callSpool != nil {
+		go runSpoolReplayer(viper.GetDuration("SPOOL_REPLAY_INTERVAL"), setUp)
+	}
+	if viper.GetString("STORE") == storePostgres {
+		go runRollupJob(time.Hour)
+		go runRetentionJanitor(time.Hour)
+		if viper.GetBool("PARTITION_CALLS") {
+			go runPartitionJob(time.Hour)
+		}
+	}
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%s", viper.GetString("PORT")), Handler: buildServer()}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("cannot serve")
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	shutdown(srv, queue, sink)
+}
+
+// shutdown stops taking requests, waits for the ones in flight and stores
+// everything that is still buffered, within SHUTDOWN_TIMEOUT.
+func shutdown(srv *http.Server, queue *queuedStore, sink *clickHouseSink) {
+	log.Info().Msg("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("SHUTDOWN_TIMEOUT"))
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("cannot finish the requests in flight")
+	}
+	if queue != nil {
+		if err := queue.close(ctx); err != nil {
+			log.Error().Err(err).Msg("cannot drain the ingest queue")
+		}
+	}
+	if sink != nil {
+		if err := sink.flush(); err != nil {
+			log.Error().Err(err).Msg("can't copy calls to clickhouse")
+		}
 	}
-	g := buildServer()
-	g.Run(fmt.Sprintf(":%s", viper.GetString("PORT")))
+	flushTallies()
 }
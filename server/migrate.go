@@ -0,0 +1,469 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// migrationLockKey identifies the advisory lock that keeps server instances
+// from migrating at the same time.
+const migrationLockKey = 7210366
+
+var errInitialSchemaDown = errors.New("the initial schema can't be reverted, it would drop all calls")
+
+// initialSchemaSQL creates the tables as they were when migrations were
+// introduced. Databases that were created before already have some of them,
+// and calls tables of the first releases lack the newer columns.
+var initialSchemaSQL = []string{
+	`CREATE TABLE IF NOT EXISTS calls (
+		id bigserial,
+		timestamp timestamptz,
+		client_timestamp timestamptz,
+		payload jsonb,
+		organisation text NOT NULL,
+		repository text NOT NULL,
+		event text NOT NULL DEFAULT '',
+		origin text,
+		PRIMARY KEY (id)
+	)`,
+	"ALTER TABLE calls ADD COLUMN IF NOT EXISTS client_timestamp timestamptz",
+	"ALTER TABLE calls ADD COLUMN IF NOT EXISTS event text NOT NULL DEFAULT ''",
+	"CREATE INDEX IF NOT EXISTS idx_calls_event ON calls (organisation, repository, event)",
+	`CREATE TABLE IF NOT EXISTS origin_salts (
+		valid_from timestamptz,
+		salt bytea NOT NULL,
+		PRIMARY KEY (valid_from)
+	)`,
+	`CREATE TABLE IF NOT EXISTS repositories (
+		organisation text,
+		repository text,
+		claim_token text,
+		claimed_at timestamptz,
+		visibility text NOT NULL DEFAULT 'public',
+		public_badge boolean NOT NULL DEFAULT false,
+		retention_days bigint,
+		rollup_expired boolean,
+		PRIMARY KEY (organisation, repository)
+	)`,
+	`CREATE TABLE IF NOT EXISTS repo_tokens (
+		id bigserial,
+		organisation text NOT NULL,
+		repository text NOT NULL,
+		scope text NOT NULL,
+		hash text NOT NULL,
+		description text,
+		created_at timestamptz,
+		PRIMARY KEY (id)
+	)`,
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_repo_tokens_hash ON repo_tokens (hash)",
+	"CREATE INDEX IF NOT EXISTS idx_repo_tokens_org_repo ON repo_tokens (organisation, repository)",
+	`CREATE TABLE IF NOT EXISTS dropped_calls (
+		organisation text,
+		repository text,
+		day text,
+		reason text,
+		count bigint NOT NULL,
+		PRIMARY KEY (organisation, repository, day, reason)
+	)`,
+	`CREATE TABLE IF NOT EXISTS repository_schemas (
+		organisation text,
+		repository text,
+		schema jsonb NOT NULL,
+		updated_at timestamptz,
+		PRIMARY KEY (organisation, repository)
+	)`,
+	`CREATE TABLE IF NOT EXISTS schema_violations (
+		organisation text,
+		repository text,
+		day text,
+		key text,
+		reason text,
+		count bigint NOT NULL,
+		PRIMARY KEY (organisation, repository, day, key, reason)
+	)`,
+	`CREATE TABLE IF NOT EXISTS repository_scrubbings (
+		organisation text,
+		repository text,
+		config jsonb NOT NULL,
+		updated_at timestamptz,
+		PRIMARY KEY (organisation, repository)
+	)`,
+	`CREATE TABLE IF NOT EXISTS call_rollups (
+		organisation text,
+		repository text,
+		day text,
+		event text,
+		key text,
+		count bigint NOT NULL,
+		origins bigint NOT NULL,
+		PRIMARY KEY (organisation, repository, day, event, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS rollup_watermarks (
+		organisation text,
+		repository text,
+		day text NOT NULL,
+		PRIMARY KEY (organisation, repository)
+	)`,
+}
+
+// migration is a versioned, reversible change of the database schema.
+// Migrations that can't run in a transaction, like creating indexes
+// concurrently, set noTx. Migrations are plain SQL so that they keep doing
+// the same thing when the models change later on.
+type migration struct {
+	version int
+	name    string
+	noTx    bool
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration.
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// migrationState is a migration and when it was applied, if it was.
+type migrationState struct {
+	version   int
+	name      string
+	appliedAt *time.Time
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial_schema",
+		up: func(tx *gorm.DB) error {
+			return execAll(tx, initialSchemaSQL)
+		},
+		down: func(tx *gorm.DB) error {
+			return errInitialSchemaDown
+		},
+	},
+	{
+		version: 2,
+		name:    "calls_org_repo_timestamp_index",
+		noTx:    true,
+		up: func(tx *gorm.DB) error {
+			return createIndexConcurrently(tx, "idx_calls_org_repo_timestamp", "calls (organisation, repository, timestamp)")
+		},
+		down: func(tx *gorm.DB) error {
+			return dropIndexConcurrently(tx, "idx_calls_org_repo_timestamp")
+		},
+	},
+	{
+		version: 3,
+		name:    "calls_timestamp_index",
+		noTx:    true,
+		up: func(tx *gorm.DB) error {
+			// for the rollup and retention jobs, which look at all repositories
+			return createIndexConcurrently(tx, "idx_calls_timestamp", "calls (timestamp)")
+		},
+		down: func(tx *gorm.DB) error {
+			return dropIndexConcurrently(tx, "idx_calls_timestamp")
+		},
+	},
+	{
+		version: 4,
+		name:    "calls_payload_gin_index",
+		noTx:    true,
+		up: func(tx *gorm.DB) error {
+			// jsonb_ops rather than jsonb_path_ops, as key filters use the ? operator
+			return createIndexConcurrently(tx, "idx_calls_payload", "calls USING gin (payload)")
+		},
+		down: func(tx *gorm.DB) error {
+			return dropIndexConcurrently(tx, "idx_calls_payload")
+		},
+	},
+	{
+		version: 5,
+		name:    "call_attributes",
+		up: func(tx *gorm.DB) error {
+			// no foreign key, as the primary key of partitioned calls includes timestamp
+			return execAll(tx, []string{
+				`CREATE TABLE IF NOT EXISTS call_attributes (
+					call_id bigint NOT NULL,
+					key text NOT NULL,
+					value_text text,
+					value_num numeric
+				)`,
+				"CREATE INDEX IF NOT EXISTS idx_call_attributes_call ON call_attributes (call_id)",
+				"CREATE INDEX IF NOT EXISTS idx_call_attributes_text ON call_attributes (key, value_text)",
+				"CREATE INDEX IF NOT EXISTS idx_call_attributes_num ON call_attributes (key, value_num)",
+			})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Exec("DROP TABLE IF EXISTS call_attributes").Error
+		},
+	},
+}
+
+// execAll runs statements in order.
+func execAll(tx *gorm.DB, statements []string) error {
+	for _, stmt := range statements {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeModels are the tables of the SQLite and memory stores, which are
+// created from the models rather than migrated.
+func storeModels() []interface{} {
+	return []interface{}{
+		&Call{}, &OriginSalt{}, &Repository{}, &RepoToken{}, &DroppedCall{}, &RepositorySchema{}, &SchemaViolation{},
+		&RepositoryScrubbing{}, &CallRollup{}, &RollupWatermark{},
+	}
+}
+
+// createIndexConcurrently creates an index without blocking writes. A
+// concurrent build that failed leaves an invalid index behind, which is
+// dropped first so that the migration can be retried. Indexes on partitioned
+// tables can't be built concurrently, these lock the table instead.
+func createIndexConcurrently(tx *gorm.DB, name string, definition string) error {
+	partitioned, err := callsPartitioned(tx)
+	if err != nil {
+		return err
+	}
+	if partitioned {
+		return tx.Exec("CREATE INDEX IF NOT EXISTS " + name + " ON " + definition).Error
+	}
+
+	var invalid bool
+	err = tx.Raw(`SELECT EXISTS (
+		SELECT 1 FROM pg_index i JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE c.relname = ? AND NOT i.indisvalid)`, name).Scan(&invalid).Error
+	if err != nil {
+		return err
+	}
+
+	if invalid {
+		if err := tx.Exec("DROP INDEX CONCURRENTLY IF EXISTS " + name).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Exec("CREATE INDEX CONCURRENTLY IF NOT EXISTS " + name + " ON " + definition).Error
+}
+
+func dropIndexConcurrently(tx *gorm.DB, name string) error {
+	partitioned, err := callsPartitioned(tx)
+	if err != nil {
+		return err
+	}
+	if partitioned {
+		return tx.Exec("DROP INDEX IF EXISTS " + name).Error
+	}
+	return tx.Exec("DROP INDEX CONCURRENTLY IF EXISTS " + name).Error
+}
+
+// withMigrationLock runs fc on a single connection that holds the migration lock.
+func withMigrationLock(fc func(conn *gorm.DB) error) error {
+	return db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SELECT pg_advisory_lock(?)", migrationLockKey).Error; err != nil {
+			return err
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?)", migrationLockKey)
+
+		if err := conn.AutoMigrate(&SchemaMigration{}); err != nil {
+			return err
+		}
+		return fc(conn)
+	})
+}
+
+func appliedMigrations(conn *gorm.DB) (map[int]SchemaMigration, error) {
+	var sms []SchemaMigration
+	if err := conn.Find(&sms).Error; err != nil {
+		return nil, err
+	}
+
+	applied := map[int]SchemaMigration{}
+	for _, sm := range sms {
+		applied[sm.Version] = sm
+	}
+	return applied, nil
+}
+
+func runMigration(conn *gorm.DB, m migration, fc func(tx *gorm.DB) error, record func(tx *gorm.DB) error) error {
+	if m.noTx {
+		if err := fc(conn); err != nil {
+			return err
+		}
+		return record(conn)
+	}
+
+	return conn.Transaction(func(tx *gorm.DB) error {
+		if err := fc(tx); err != nil {
+			return err
+		}
+		return record(tx)
+	})
+}
+
+// migrateUp applies the pending migrations up to and including version
+// target, all of them when target is 0.
+func migrateUp(target int) ([]migrationState, error) {
+	var done []migrationState
+
+	err := withMigrationLock(func(conn *gorm.DB) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			if target > 0 && m.version > target {
+				break
+			}
+
+			now := time.Now()
+			err := runMigration(conn, m, m.up, func(tx *gorm.DB) error {
+				return tx.Create(&SchemaMigration{Version: m.version, Name: m.name, AppliedAt: now}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+			}
+			done = append(done, migrationState{m.version, m.name, &now})
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// migrateDown reverts the last steps applied migrations.
+func migrateDown(steps int) ([]migrationState, error) {
+	var done []migrationState
+
+	err := withMigrationLock(func(conn *gorm.DB) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.version]; !ok {
+				continue
+			}
+
+			err := runMigration(conn, m, m.down, func(tx *gorm.DB) error {
+				return tx.Delete(&SchemaMigration{}, m.version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+			}
+			done = append(done, migrationState{m.version, m.name, nil})
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+func migrationStatus() ([]migrationState, error) {
+	var states []migrationState
+
+	err := withMigrationLock(func(conn *gorm.DB) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			ms := migrationState{version: m.version, name: m.name}
+			if sm, ok := applied[m.version]; ok {
+				ms.appliedAt = &sm.AppliedAt
+			}
+			states = append(states, ms)
+		}
+		return nil
+	})
+
+	return states, err
+}
+
+// migrateCommand runs `phonehome migrate up [version]`, `migrate down [steps]`,
+// `migrate status`, `migrate partition`, `migrate attributes` or
+// `migrate clickhouse` and returns the exit code.
+func migrateCommand(args []string) int {
+	usage := "usage: phonehome migrate up [version] | down [steps] | status | partition | attributes | clickhouse"
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	n := 0
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+	}
+
+	var states []migrationState
+	var err error
+	switch args[0] {
+	case "up":
+		states, err = migrateUp(n)
+	case "down":
+		if n == 0 {
+			n = 1
+		}
+		states, err = migrateDown(n)
+	case "status":
+		states, err = migrationStatus()
+	case "attributes":
+		var n int64
+		n, err = backfillCallAttributes(10000)
+		fmt.Printf("added %d call attributes\n", n)
+	case "clickhouse":
+		var n int64
+		n, err = backfillClickHouse(10000)
+		fmt.Printf("copied %d calls to clickhouse\n", n)
+	case "partition":
+		err = partitionCalls(time.Now())
+		if err == nil {
+			err = createPartitions(time.Now())
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, ms := range states {
+		status := "pending"
+		if ms.appliedAt != nil {
+			status = "applied " + ms.appliedAt.Format(time.RFC3339)
+		}
+		if args[0] == "down" {
+			status = "reverted"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", ms.version, ms.name, status)
+	}
+	w.Flush()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
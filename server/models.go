@@ -7,6 +7,7 @@ import (
 	"time"
 
 	pgd "github.com/jinzhu/gorm/dialects/postgres"
+	"gorm.io/datatypes"
 )
 
 const YYYYMMDDLayout = "2006-01-02"
@@ -34,7 +35,8 @@ type DefaultResp struct {
 
 type CallsResp struct {
 	DefaultResp
-	Data []Call `json:"data"`
+	Data       []Call `json:"data"`
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type CountResp struct {
@@ -47,29 +49,303 @@ type DailyCountResp struct {
 	Data DayCounts `json:"data"`
 }
 
+type SeriesCountResp struct {
+	DefaultResp
+	Data SeriesCounts `json:"data"`
+}
+
+type DroppedCountResp struct {
+	DefaultResp
+	Data []DroppedCall `json:"data"`
+}
+
+type GroupedCountResp struct {
+	DefaultResp
+	Data ValueCounts `json:"data"`
+}
+
+type GroupedDailyCountResp struct {
+	DefaultResp
+	Data []ValueDayCounts `json:"data"`
+}
+
 type RegisterResp struct {
 	DefaultResp
-	Payload json.RawMessage `json:"payload" swaggertype:"object"`
-	Error   string          `json:"error,omitempty"`
-	Message string          `json:"message,omitempty"`
+	Payload    json.RawMessage `json:"payload" swaggertype:"object"`
+	Stripped   []KeyIssue      `json:"stripped,omitempty"`
+	Redactions int             `json:"redactions,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Message    string          `json:"message,omitempty"`
+}
+
+type BatchResult struct {
+	Index      int             `json:"index"`
+	Status     string          `json:"status" enums:"accepted,stripped,rejected"`
+	Payload    json.RawMessage `json:"payload,omitempty" swaggertype:"object"`
+	Stripped   []KeyIssue      `json:"stripped,omitempty"`
+	Redactions int             `json:"redactions,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// SpooledResp answers calls that were spooled while the database was
+// unavailable.
+type SpooledResp struct {
+	DefaultResp
+	Message string `json:"message"`
+}
+
+type BatchResp struct {
+	DefaultResp
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Results  []BatchResult `json:"results"`
+}
+
+type InfoResp struct {
+	DefaultResp
+	Limits PayloadLimits `json:"limits"`
+}
+
+type ClaimResp struct {
+	DefaultResp
+	Token   string `json:"token,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type TokenRequest struct {
+	Scope       string `json:"scope" binding:"required" enums:"read,write,admin"`
+	Description string `json:"description"`
+}
+
+type TokenResp struct {
+	DefaultResp
+	Token string     `json:"token,omitempty"`
+	Data  *RepoToken `json:"data,omitempty"`
+}
+
+type RepositoryResp struct {
+	DefaultResp
+	Data *Repository `json:"data,omitempty"`
+}
+
+type TokensResp struct {
+	DefaultResp
+	Data []RepoToken `json:"data"`
+}
+
+type SchemaResp struct {
+	DefaultResp
+	Data *PayloadSchema `json:"data,omitempty"`
+}
+
+type ScrubConfigResp struct {
+	DefaultResp
+	Data *ScrubConfig `json:"data,omitempty"`
+}
+
+type SchemaViolationsResp struct {
+	DefaultResp
+	Data []SchemaViolation `json:"data"`
 }
 
+// Call is a registered telemetry call. Timestamp is when the server received
+// it, ClientTimestamp when it happened according to the client, if passed.
 type Call struct {
-	ID           uint      `gorm:"primaryKey" json:"-"`
-	Timestamp    time.Time `json:"timestamp" swaggerignore:"true"`
-	Payload      pgd.Jsonb `gorm:"type:jsonb" json:"payload" swaggertype:"object"`
-	Organisation string    `gorm:"not null" json:"organisation"`
-	Repository   string    `gorm:"not null" json:"repository"`
-	Origin       string    `json:"origin"`
+	ID              uint       `gorm:"primaryKey" json:"-"`
+	Timestamp       time.Time  `json:"timestamp" swaggerignore:"true"`
+	ClientTimestamp *time.Time `json:"client_timestamp,omitempty" swaggerignore:"true"`
+	Payload         pgd.Jsonb  `gorm:"type:jsonb" json:"payload" swaggertype:"object"`
+	Organisation    string     `gorm:"not null;index:idx_calls_event,priority:1" json:"organisation"`
+	Repository      string     `gorm:"not null;index:idx_calls_event,priority:2" json:"repository"`
+	Event           string     `gorm:"not null;default:'';index:idx_calls_event,priority:3" json:"event,omitempty"`
+	Origin          string     `json:"origin"`
 }
 
 type CallPayload map[string]interface{}
 
-type DayCounts []struct {
+// CallAttribute is a key of the payload of a call with its value, as text
+// and as a number for numbers. Arrays are kept as their JSON text.
+type CallAttribute struct {
+	CallID    uint
+	Key       string
+	ValueText *string
+	ValueNum  *float64
+}
+
+// Repository holds the ownership state of a repository that is being or has
+// been claimed by its maintainers, and its settings. RetentionDays and
+// RollupExpired fall back to the defaults of the server when nil.
+type Repository struct {
+	Organisation  string     `gorm:"primaryKey" json:"organisation"`
+	Repository    string     `gorm:"primaryKey" json:"repository"`
+	ClaimToken    string     `json:"-"`
+	ClaimedAt     *time.Time `json:"claimed_at,omitempty"`
+	Visibility    string     `gorm:"not null;default:public" json:"visibility" enums:"public,private"`
+	PublicBadge   bool       `gorm:"not null;default:false" json:"public_badge"`
+	RetentionDays *int       `json:"retention_days,omitempty"`
+	RollupExpired *bool      `json:"rollup_expired,omitempty"`
+}
+
+// RepositorySettings is a partial update of the settings of a Repository,
+// fields that are left out keep their value. RetentionDays is how long raw
+// calls are kept, 0 keeps them forever. RollupExpired keeps counting expired
+// calls in daily aggregates.
+type RepositorySettings struct {
+	Visibility    *string `json:"visibility" enums:"public,private"`
+	PublicBadge   *bool   `json:"public_badge"`
+	RetentionDays *int    `json:"retention_days"`
+	RollupExpired *bool   `json:"rollup_expired"`
+}
+
+// RepoToken is an API token of a claimed repository. Only a hash of the
+// token itself is stored.
+type RepoToken struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Organisation string    `gorm:"not null;index:idx_repo_tokens_org_repo" json:"-"`
+	Repository   string    `gorm:"not null;index:idx_repo_tokens_org_repo" json:"-"`
+	Scope        string    `gorm:"not null" json:"scope"`
+	Hash         string    `gorm:"not null;uniqueIndex" json:"-"`
+	Description  string    `json:"description,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// DroppedCall counts the calls of a day that were not registered, per reason.
+type DroppedCall struct {
+	Organisation string `gorm:"primaryKey" json:"-"`
+	Repository   string `gorm:"primaryKey" json:"-"`
+	Day          string `gorm:"primaryKey" json:"date"`
+	Reason       string `gorm:"primaryKey" json:"reason"`
+	Count        int64  `gorm:"not null" json:"count"`
+}
+
+// PayloadSchema lists the payload keys a repository expects. In `report`
+// mode calls that don't match are registered and their violations counted,
+// in `reject` mode they are refused.
+type PayloadSchema struct {
+	Mode string               `json:"mode" enums:"report,reject"`
+	Keys map[string]SchemaKey `json:"keys"`
+}
+
+// SchemaKey describes the values allowed for a single payload key. Nullable
+// keys can be null instead of a value of their type.
+type SchemaKey struct {
+	Type      string        `json:"type" enums:"string,number,boolean,array"`
+	Enum      []interface{} `json:"enum,omitempty" swaggertype:"array,string"`
+	MaxLength int           `json:"max_length,omitempty"`
+	Required  bool          `json:"required,omitempty"`
+	Nullable  bool          `json:"nullable,omitempty"`
+}
+
+// RepositorySchema is the PayloadSchema registered for a repository.
+type RepositorySchema struct {
+	Organisation string         `gorm:"primaryKey"`
+	Repository   string         `gorm:"primaryKey"`
+	Schema       datatypes.JSON `gorm:"not null"`
+	UpdatedAt    time.Time
+}
+
+// ScrubRule masks the matches of Pattern in payload strings with Replacement,
+// which can refer to submatches as in `${1}`.
+type ScrubRule struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// ScrubConfig is how the payloads of a repository are scrubbed. When set,
+// Detectors replaces the built-in detectors the server enables by default.
+// Rules are applied on top of the rules of the server.
+type ScrubConfig struct {
+	Detectors *[]string   `json:"detectors,omitempty" enums:"email,ip,home_path,api_key"`
+	Rules     []ScrubRule `json:"rules"`
+}
+
+// RepositoryScrubbing is the ScrubConfig registered for a repository.
+type RepositoryScrubbing struct {
+	Organisation string         `gorm:"primaryKey"`
+	Repository   string         `gorm:"primaryKey"`
+	Config       datatypes.JSON `gorm:"not null"`
+	UpdatedAt    time.Time
+}
+
+// KeyIssue is a problem with a single payload key.
+type KeyIssue struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// SchemaViolation counts how often a key violated the schema of its
+// repository on a day, per reason.
+type SchemaViolation struct {
+	Organisation string `gorm:"primaryKey" json:"-"`
+	Repository   string `gorm:"primaryKey" json:"-"`
+	Day          string `gorm:"primaryKey" json:"date"`
+	Key          string `gorm:"primaryKey" json:"key"`
+	Reason       string `gorm:"primaryKey" json:"reason"`
+	Count        int64  `gorm:"not null" json:"count"`
+}
+
+// CallRollup counts the calls of a repository on a day in the timezone of
+// the server. Event `*` counts all events, Key "" all calls and any other key
+// the calls that have that payload key.
+type CallRollup struct {
+	Organisation string `gorm:"primaryKey"`
+	Repository   string `gorm:"primaryKey"`
+	Day          string `gorm:"primaryKey"`
+	Event        string `gorm:"primaryKey"`
+	Key          string `gorm:"primaryKey"`
+	Count        int64  `gorm:"not null"`
+	Origins      int64  `gorm:"not null"`
+}
+
+// RollupWatermark is the first day of a repository that is not rolled up.
+type RollupWatermark struct {
+	Organisation string `gorm:"primaryKey"`
+	Repository   string `gorm:"primaryKey"`
+	Day          string `gorm:"not null"`
+}
+
+// OriginSalt is the random salt used to hash client IPs during one rotation window.
+type OriginSalt struct {
+	ValidFrom time.Time `gorm:"primaryKey"`
+	Salt      []byte    `gorm:"not null"`
+}
+
+type DayCount struct {
 	Date  string `json:"date,omitempty"`
 	Count int64  `json:"count,omitempty"`
 }
 
+type DayCounts []DayCount
+
+type SeriesCount struct {
+	Bucket string `json:"bucket"`
+	Count  int64  `json:"count"`
+}
+
+type SeriesCounts []SeriesCount
+
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type ValueCounts []ValueCount
+
+// ValueDayCounts is the daily series of a single value of the grouped key.
+type ValueDayCounts struct {
+	Value string    `json:"value"`
+	Data  DayCounts `json:"data"`
+}
+
+// PayloadFilter compares the value of a payload key, parsed from a
+// `key:op:value` where query parameter.
+type PayloadFilter struct {
+	Key   string
+	Op    string
+	Value string
+}
+
 type OrgRepoURI struct {
 	Organisation string `uri:"organisation" binding:"required"`
 	Repository   string `uri:"repository" binding:"required"`
@@ -80,16 +356,27 @@ type (
 	FilterQuery struct {
 		GroupBy      string    `form:"group_by" json:"group_by,omitempty"`
 		Key          string    `form:"key" json:"key,omitempty"`
-		FromDate     *JsonDate `json:"from_date,omitempty"`
-		ToDate       *JsonDate `json:"to_date,omitempty"`
+		Event        string    `form:"event" json:"event,omitempty"`
+		Where        []string  `form:"where" json:"where,omitempty"`
+		Limit        int       `form:"limit" json:"limit,omitempty"`
+		Cursor       string    `form:"cursor" json:"cursor,omitempty"`
+		Interval     string    `form:"interval" json:"interval,omitempty"`
+		TZ           string    `form:"tz" json:"tz,omitempty"`
+		Unique       bool      `form:"unique" json:"unique,omitempty"`
+		TimeField    string    `form:"time" json:"time,omitempty"`
+		FromDate     *JsonDate `form:"-" json:"from_date,omitempty"`
+		ToDate       *JsonDate `form:"-" json:"to_date,omitempty"`
 		Organisation string    `json:"organisation,omitempty"`
 		Repository   string    `json:"repository,omitempty"`
 	}
 )
 
 func (jd *JsonDate) UnmarshalJSON(b []byte) error {
-	s := strings.Trim(string(b), "\"")
-	t, err := time.Parse(YYYYMMDDLayout, s)
+	return jd.UnmarshalText([]byte(strings.Trim(string(b), "\"")))
+}
+
+func (jd *JsonDate) UnmarshalText(b []byte) error {
+	t, err := time.Parse(YYYYMMDDLayout, string(b))
 	if err != nil {
 		return err
 	}
@@ -97,6 +384,16 @@ func (jd *JsonDate) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+func (jd JsonDate) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + time.Time(jd).Format(YYYYMMDDLayout) + `"`), nil
+}
+
+// In returns midnight of the date in the given location.
+func (jd JsonDate) In(loc *time.Location) time.Time {
+	t := time.Time(jd)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
 func (fq *FilterQuery) AddOrgRepo(or OrgRepoURI) {
 	fq.Organisation = or.Organisation
 	fq.Repository = or.Repository
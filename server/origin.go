@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+const originCtxKey = "origin"
+
+var (
+	originSecret       string
+	originSaltRotation time.Duration
+
+	// originSaltCache holds the salt of the current rotation window so it
+	// only has to be fetched from the database once per window.
+	originSaltCache struct {
+		sync.Mutex
+		validFrom time.Time
+		salt      []byte
+	}
+
+	// spoolSalt stands in for the salt of the current rotation window when
+	// calls are spooled before that salt could be fetched. It is only kept in
+	// memory, so the origins hashed with it can't be traced back to IP
+	// addresses once the window is over or the server stops.
+	spoolSalt struct {
+		sync.Mutex
+		validFrom time.Time
+		salt      []byte
+	}
+)
+
+// originHash returns the pseudonymous origin stored with a call: a keyed hash
+// of the client IP and the repository. The key combines the configured secret
+// with a random salt that rotates every ORIGIN_SALT_ROTATION, so origins can
+// only be linked to each other within a single rotation window.
+func originHash(ip string, org string, repo string) (string, error) {
+	return originHashAt(ip, org, repo, time.Now())
+}
+
+// callOrigin returns the origin hash of the request, only computing it once
+// per request.
+func callOrigin(c *gin.Context) (string, error) {
+	if origin, ok := c.Get(originCtxKey); ok {
+		return origin.(string), nil
+	}
+
+	origin, err := originHash(c.ClientIP(), c.Param("organisation"), c.Param("repository"))
+	if err != nil {
+		return "", err
+	}
+	c.Set(originCtxKey, origin)
+
+	return origin, nil
+}
+
+func originHashAt(ip string, org string, repo string, now time.Time) (string, error) {
+	salt, err := originSalt(now)
+	if err != nil {
+		return "", err
+	}
+	return originMAC(salt, ip, org, repo), nil
+}
+
+func originMAC(salt []byte, ip string, org string, repo string) string {
+	mac := hmac.New(sha256.New, append([]byte(originSecret), salt...))
+	mac.Write([]byte(ip + "\n" + org + "/" + repo))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// cachedOriginSalt returns the salt of the rotation window now falls in when
+// it is cached, so without going to the database.
+func cachedOriginSalt(now time.Time) ([]byte, bool) {
+	originSaltCache.Lock()
+	defer originSaltCache.Unlock()
+
+	if originSaltCache.salt == nil || !originSaltCache.validFrom.Equal(now.UTC().Truncate(originSaltRotation)) {
+		return nil, false
+	}
+	return originSaltCache.salt, true
+}
+
+// spoolOrigin returns the origin of a call that is spooled at now, without
+// going to the database. Without the salt of the window at hand the origin is
+// hashed with spoolSalt instead, it then won't match the origins of calls
+// from the same IP address that were stored rather than spooled.
+func spoolOrigin(ip string, org string, repo string, now time.Time) (string, error) {
+	if salt, ok := cachedOriginSalt(now); ok {
+		return originMAC(salt, ip, org, repo), nil
+	}
+
+	validFrom := now.UTC().Truncate(originSaltRotation)
+
+	spoolSalt.Lock()
+	defer spoolSalt.Unlock()
+
+	if !spoolSalt.validFrom.Equal(validFrom) {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		spoolSalt.validFrom = validFrom
+		spoolSalt.salt = salt
+	}
+
+	return originMAC(spoolSalt.salt, ip, org, repo), nil
+}
+
+// originSalt returns the salt of the rotation window now falls in, creating it
+// when this is the first call of the window. Salts of earlier windows are
+// deleted so their hashes can't be brute-forced back into IP addresses.
+// Asking for the salt of an earlier window doesn't replace the cached salt
+// of the current one.
+func originSalt(now time.Time) ([]byte, error) {
+	validFrom := now.UTC().Truncate(originSaltRotation)
+	past := validFrom.Before(time.Now().UTC().Truncate(originSaltRotation))
+
+	originSaltCache.Lock()
+	defer originSaltCache.Unlock()
+
+	if originSaltCache.validFrom.Equal(validFrom) {
+		return originSaltCache.salt, nil
+	}
+
+	salt := OriginSalt{ValidFrom: validFrom, Salt: make([]byte, 32)}
+	if _, err := rand.Read(salt.Salt); err != nil {
+		return nil, err
+	}
+
+	// another server instance might have created the salt for this window already
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&salt).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Where("valid_from = ?", validFrom).First(&salt).Error; err != nil {
+		return nil, err
+	}
+	if past {
+		return salt.Salt, nil
+	}
+
+	if err := db.Where("valid_from < ?", validFrom).Delete(&OriginSalt{}).Error; err != nil {
+		return nil, err
+	}
+
+	originSaltCache.validFrom = validFrom
+	originSaltCache.salt = salt.Salt
+
+	return salt.Salt, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Partitions of the calls table hold a month of calls in the timezone of the
+// server and are named after it, calls_p202301 holds January 2023. The calls
+// received before the table was partitioned stay in a single partition named
+// after the month it ends with, calls_until202302 for instance. Calls outside
+// of all months go to the default partition.
+const (
+	partitionPrefix       = "calls_p"
+	legacyPartitionPrefix = "calls_until"
+	defaultPartitionName  = "calls_default"
+	partitionMonthLayout  = "200601"
+)
+
+var errCallsNotPartitioned = errors.New("calls is not partitioned, run `phonehome migrate partition` first")
+
+func callsPartitioned(tx *gorm.DB) (bool, error) {
+	var partitioned bool
+	err := tx.Raw("SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = 'calls'::regclass)").Scan(&partitioned).Error
+	return partitioned, err
+}
+
+func callsPartitions() ([]string, error) {
+	var partitions []string
+	err := db.Raw("SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = 'calls'::regclass").
+		Scan(&partitions).Error
+	return partitions, err
+}
+
+// monthStart is the start of the month of t in the timezone of the server.
+func monthStart(t time.Time) (time.Time, error) {
+	loc, err := filterLocation(FilterQuery{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc), nil
+}
+
+// partitionBound is t as a partition bound literal.
+func partitionBound(t time.Time) string {
+	return "'" + t.Format(time.RFC3339) + "'"
+}
+
+// partitionUpperBound returns the end of the calls in a partition, false for
+// partitions that are not named after a month.
+func partitionUpperBound(name string) (time.Time, bool) {
+	loc, err := filterLocation(FilterQuery{})
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	if strings.HasPrefix(name, partitionPrefix) {
+		month, err := time.ParseInLocation(partitionMonthLayout, strings.TrimPrefix(name, partitionPrefix), loc)
+		return month.AddDate(0, 1, 0), err == nil
+	}
+	if strings.HasPrefix(name, legacyPartitionPrefix) {
+		month, err := time.ParseInLocation(partitionMonthLayout, strings.TrimPrefix(name, legacyPartitionPrefix), loc)
+		return month, err == nil
+	}
+	return time.Time{}, false
+}
+
+// partitionCalls turns calls into a table that is partitioned by month on
+// timestamp. The existing calls are not copied, the old table becomes the
+// partition of everything up to next month. The table is locked while the
+// primary key of that partition is extended with timestamp, which partitioned
+// tables require.
+func partitionCalls(now time.Time) error {
+	next, err := monthStart(now)
+	if err != nil {
+		return err
+	}
+	next = next.AddDate(0, 1, 0)
+	legacy := legacyPartitionPrefix + next.Format(partitionMonthLayout)
+
+	return withMigrationLock(func(conn *gorm.DB) error {
+		partitioned, err := callsPartitioned(conn)
+		if err != nil || partitioned {
+			return err
+		}
+
+		return conn.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("LOCK TABLE calls IN ACCESS EXCLUSIVE MODE").Error; err != nil {
+				return err
+			}
+
+			var seq *string
+			if err := tx.Raw("SELECT pg_get_serial_sequence('calls', 'id')").Scan(&seq).Error; err != nil {
+				return err
+			}
+
+			var pkey string
+			err := tx.Raw("SELECT conname FROM pg_constraint WHERE conrelid = 'calls'::regclass AND contype = 'p'").Scan(&pkey).Error
+			if err != nil {
+				return err
+			}
+
+			var indexes []struct {
+				Name       string
+				Definition string
+			}
+			err = tx.Raw(`SELECT i.relname AS name, pg_get_indexdef(i.oid) AS definition
+				FROM pg_index x JOIN pg_class i ON i.oid = x.indexrelid
+				WHERE x.indrelid = 'calls'::regclass AND NOT x.indisprimary`).Scan(&indexes).Error
+			if err != nil {
+				return err
+			}
+
+			stmts := []string{"ALTER TABLE calls RENAME TO " + legacy}
+			if pkey != "" {
+				stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s RENAME CONSTRAINT %s TO %s_pkey", legacy, pkey, legacy))
+			}
+			for _, idx := range indexes {
+				stmts = append(stmts, fmt.Sprintf("ALTER INDEX %s RENAME TO %s_%s", idx.Name, legacy, idx.Name))
+			}
+			if seq != nil {
+				stmts = append(stmts, fmt.Sprintf("ALTER SEQUENCE %s OWNED BY NONE", *seq))
+			}
+			stmts = append(stmts,
+				fmt.Sprintf("ALTER TABLE %s ALTER COLUMN timestamp SET NOT NULL", legacy),
+				fmt.Sprintf("CREATE TABLE calls (LIKE %s INCLUDING DEFAULTS INCLUDING STORAGE) PARTITION BY RANGE (timestamp)", legacy),
+				"ALTER TABLE calls ADD PRIMARY KEY (id, timestamp)",
+			)
+			// the indexes are created on the parent, the renamed ones are attached to it
+			for _, idx := range indexes {
+				stmts = append(stmts, idx.Definition)
+			}
+			if seq != nil {
+				stmts = append(stmts, fmt.Sprintf("ALTER SEQUENCE %s OWNED BY calls.id", *seq))
+			}
+			stmts = append(stmts,
+				fmt.Sprintf("ALTER TABLE calls ATTACH PARTITION %s FOR VALUES FROM (MINVALUE) TO (%s)", legacy, partitionBound(next)),
+				fmt.Sprintf("CREATE TABLE %s PARTITION OF calls DEFAULT", defaultPartitionName),
+			)
+
+			for _, stmt := range stmts {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return fmt.Errorf("%s: %w", stmt, err)
+				}
+			}
+
+			log.Info().Msgf("partitioned calls, the calls received so far are in %s", legacy)
+			return nil
+		})
+	})
+}
+
+// createPartitions creates the partitions of the current month and of the
+// PARTITION_PREMAKE_MONTHS months after it.
+func createPartitions(now time.Time) error {
+	partitioned, err := callsPartitioned(db)
+	if err != nil {
+		return err
+	}
+	if !partitioned {
+		return errCallsNotPartitioned
+	}
+
+	month, err := monthStart(now)
+	if err != nil {
+		return err
+	}
+
+	partitions, err := callsPartitions()
+	if err != nil {
+		return err
+	}
+
+	// months up to the end of the partition of the calls received before partitioning are covered
+	for _, p := range partitions {
+		if until, ok := partitionUpperBound(p); ok && strings.HasPrefix(p, legacyPartitionPrefix) && until.After(month) {
+			month = until
+		}
+	}
+
+	last, err := monthStart(now.AddDate(0, viper.GetInt("PARTITION_PREMAKE_MONTHS"), 0))
+	if err != nil {
+		return err
+	}
+
+	for ; !month.After(last); month = month.AddDate(0, 1, 0) {
+		name := partitionPrefix + month.Format(partitionMonthLayout)
+		err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF calls FOR VALUES FROM (%s) TO (%s)",
+			name, partitionBound(month), partitionBound(month.AddDate(0, 1, 0)))).Error
+		if err != nil {
+			return fmt.Errorf("can't create partition %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// dropExpiredPartitions removes the partitions whose calls are expired for
+// every repository, which is a lot cheaper than deleting them one by one.
+// The calls in them are rolled up first, or their rollups deleted, as
+// expireCalls does. With PARTITION_DETACH_EXPIRED the partitions are only
+// detached, so that they can be archived.
+func dropExpiredPartitions(now time.Time, def retentionPolicy, overrides map[string]retentionPolicy) error {
+	// calls that are kept forever can be in any partition
+	if def.days <= 0 {
+		return nil
+	}
+	maxDays := def.days
+	for _, rp := range overrides {
+		if rp.days <= 0 {
+			return nil
+		}
+		if rp.days > maxDays {
+			maxDays = rp.days
+		}
+	}
+
+	loc, err := filterLocation(FilterQuery{})
+	if err != nil {
+		return err
+	}
+	cutoff, err := dayStart(now.In(loc).AddDate(0, 0, -maxDays).Format(YYYYMMDDLayout))
+	if err != nil {
+		return err
+	}
+
+	partitions, err := callsPartitions()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range partitions {
+		until, ok := partitionUpperBound(p)
+		if !ok || until.After(cutoff) {
+			continue
+		}
+
+		var repos []OrgRepoURI
+		if err := db.Table(p).Distinct("organisation", "repository").Find(&repos).Error; err != nil {
+			return err
+		}
+		for _, r := range repos {
+			rp, ok := overrides[r.Organisation+"/"+r.Repository]
+			if !ok {
+				rp = def
+			}
+			if err := expireRollups(r.Organisation, r.Repository, until.Format(YYYYMMDDLayout), rp.rollup); err != nil {
+				return err
+			}
+		}
+
+		err = db.Exec("DELETE FROM call_attributes WHERE call_id IN (SELECT id FROM " + p + ")").Error
+		if err != nil {
+			return err
+		}
+		if err := db.Exec("ALTER TABLE calls DETACH PARTITION " + p).Error; err != nil {
+			return err
+		}
+		if viper.GetBool("PARTITION_DETACH_EXPIRED") {
+			log.Info().Msgf("detached expired partition %s", p)
+			continue
+		}
+		if err := db.Exec("DROP TABLE " + p).Error; err != nil {
+			return err
+		}
+		log.Info().Msgf("dropped expired partition %s", p)
+	}
+
+	return nil
+}
+
+// runPartitionJob periodically creates the partitions of the coming months.
+func runPartitionJob(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := createPartitions(time.Now()); err != nil {
+			log.Error().Err(err).Msg("can't create partitions")
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const dropReasonRateLimited = "rate_limited"
+
+// RateLimits are the token bucket settings used for ingestion. A rate of
+// zero or less disables the limit.
+type RateLimits struct {
+	Repository  string  `mapstructure:"repository"`
+	OriginRPS   float64 `mapstructure:"origin_rps"`
+	OriginBurst int     `mapstructure:"origin_burst"`
+	RepoRPS     float64 `mapstructure:"repo_rps"`
+	RepoBurst   int     `mapstructure:"repo_burst"`
+}
+
+var (
+	defaultRateLimits RateLimits
+	// rateLimitOverrides are keyed by organisation/repository
+	rateLimitOverrides map[string]RateLimits
+
+	originLimiters = newLimiterStore()
+	repoLimiters   = newLimiterStore()
+	// spoolLimiters are keyed by client IP, as origins can't be hashed
+	// without the database, see spoolMW
+	spoolLimiters = newLimiterStore()
+
+	droppedCalls = newDailyTally(persistDroppedCalls)
+)
+
+// loadRateLimits reads the defaults and the per repository overrides, e.g.
+//
+//	RATE_LIMIT_OVERRIDES:
+//	  - repository: datarootsio/cheek
+//	    repo_rps: 200
+//	    repo_burst: 2000
+//
+// Settings left out of an override fall back to the defaults.
+func loadRateLimits() {
+	defaultRateLimits = RateLimits{
+		OriginRPS:   viper.GetFloat64("RATE_LIMIT_ORIGIN_RPS"),
+		OriginBurst: viper.GetInt("RATE_LIMIT_ORIGIN_BURST"),
+		RepoRPS:     viper.GetFloat64("RATE_LIMIT_REPO_RPS"),
+		RepoBurst:   viper.GetInt("RATE_LIMIT_REPO_BURST"),
+	}
+
+	var overrides []RateLimits
+	if err := viper.UnmarshalKey("RATE_LIMIT_OVERRIDES", &overrides); err != nil {
+		log.Warn().Err(err).Msg("can't read RATE_LIMIT_OVERRIDES")
+	}
+
+	rateLimitOverrides = map[string]RateLimits{}
+	for _, o := range overrides {
+		rl := defaultRateLimits
+		if o.OriginRPS != 0 {
+			rl.OriginRPS = o.OriginRPS
+		}
+		if o.OriginBurst != 0 {
+			rl.OriginBurst = o.OriginBurst
+		}
+		if o.RepoRPS != 0 {
+			rl.RepoRPS = o.RepoRPS
+		}
+		if o.RepoBurst != 0 {
+			rl.RepoBurst = o.RepoBurst
+		}
+		rateLimitOverrides[o.Repository] = rl
+	}
+}
+
+func rateLimitsFor(org string, repo string) RateLimits {
+	if rl, ok := rateLimitOverrides[org+"/"+repo]; ok {
+		return rl
+	}
+	return defaultRateLimits
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// limiterStore keeps a token bucket per key, forgetting buckets that have
+// been idle for a while.
+type limiterStore struct {
+	sync.Mutex
+	limiters map[string]*limiterEntry
+}
+
+func newLimiterStore() *limiterStore {
+	return &limiterStore{limiters: map[string]*limiterEntry{}}
+}
+
+func (ls *limiterStore) get(key string, rps float64, burst int) *rate.Limiter {
+	ls.Lock()
+	defer ls.Unlock()
+
+	limit := rate.Limit(rps)
+	if rps <= 0 {
+		limit = rate.Inf
+	}
+
+	e, ok := ls.limiters[key]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(limit, burst)}
+		ls.limiters[key] = e
+	} else if e.limiter.Limit() != limit || e.limiter.Burst() != burst {
+		// config got reloaded
+		e.limiter.SetLimit(limit)
+		e.limiter.SetBurst(burst)
+	}
+	e.lastSeen = time.Now()
+
+	return e.limiter
+}
+
+func (ls *limiterStore) cleanup(idle time.Duration) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	for k, e := range ls.limiters {
+		if time.Since(e.lastSeen) > idle {
+			delete(ls.limiters, k)
+		}
+	}
+}
+
+// maxCalls is the most calls a single request can register without
+// exceeding the bursts, 0 when neither bucket limits them.
+func (rl RateLimits) maxCalls() int {
+	max := 0
+	if rl.OriginRPS > 0 {
+		max = rl.OriginBurst
+	}
+	if rl.RepoRPS > 0 && (max == 0 || rl.RepoBurst < max) {
+		max = rl.RepoBurst
+	}
+	return max
+}
+
+// allowCalls takes n tokens from both the origin and the repository bucket.
+// If either hasn't got enough no tokens are taken and the time to wait is
+// returned.
+func allowCalls(org string, repo string, origin string, n int) (bool, time.Duration) {
+	return allowCallsFrom(originLimiters, org, repo, origin, n)
+}
+
+// allowCallsFrom is allowCalls with the origin buckets of origins.
+func allowCallsFrom(origins *limiterStore, org string, repo string, origin string, n int) (bool, time.Duration) {
+	rl := rateLimitsFor(org, repo)
+	now := time.Now()
+
+	originRes, d := reserveTokens(origins.get(origin, rl.OriginRPS, rl.OriginBurst), now, n)
+	if originRes == nil {
+		return false, d
+	}
+	repoRes, d := reserveTokens(repoLimiters.get(org+"/"+repo, rl.RepoRPS, rl.RepoBurst), now, n)
+	if repoRes == nil {
+		originRes.CancelAt(now)
+		return false, d
+	}
+
+	return true, 0
+}
+
+// reserveTokens takes n tokens from l. If it hasn't got enough no tokens are
+// taken and the time to wait is returned.
+func reserveTokens(l *rate.Limiter, now time.Time, n int) (*rate.Reservation, time.Duration) {
+	res := l.ReserveN(now, n)
+	if !res.OK() {
+		return nil, time.Minute
+	}
+	if d := res.DelayFrom(now); d > 0 {
+		res.CancelAt(now)
+		return nil, d
+	}
+	return res, 0
+}
+
+func setRetryAfter(c *gin.Context, d time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// abortRateLimited answers a request that exceeds a rate limit and counts
+// its n calls as dropped.
+func abortRateLimited(c *gin.Context, org string, repo string, n int, retryAfter time.Duration) {
+	droppedCalls.add(org, repo, dropReasonRateLimited, "", int64(n))
+
+	setRetryAfter(c, retryAfter)
+	resp := DefaultResp{Error: fmt.Sprintf("rate limit exceeded for %s/%s", org, repo)}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, resp)
+}
+
+// originRateLimitMW takes a token from the bucket of the origin of the
+// request. It runs before the request is authorized, so that a flood from a
+// single origin is turned away without looking up tokens.
+func originRateLimitMW(c *gin.Context) {
+	org := c.Param("organisation")
+	repo := c.Param("repository")
+
+	origin, err := callOrigin(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, DefaultResp{Error: err.Error()})
+		return
+	}
+
+	rl := rateLimitsFor(org, repo)
+	if res, retryAfter := reserveTokens(originLimiters.get(origin, rl.OriginRPS, rl.OriginBurst), time.Now(), 1); res == nil {
+		abortRateLimited(c, org, repo, 1, retryAfter)
+		return
+	}
+
+	c.Next()
+}
+
+// repoRateLimitMW takes a token from the bucket of the repository. It runs
+// once the request is authorized, so that callers without a valid write
+// token can't use up the calls of a repository.
+//
+// Batches take a token from both buckets for each of their other calls once
+// they are split, see registerBatchHandler. A batch that is rejected by a
+// middleware is counted as a single dropped call.
+func repoRateLimitMW(c *gin.Context) {
+	org := c.Param("organisation")
+	repo := c.Param("repository")
+
+	rl := rateLimitsFor(org, repo)
+	if res, retryAfter := reserveTokens(repoLimiters.get(org+"/"+repo, rl.RepoRPS, rl.RepoBurst), time.Now(), 1); res == nil {
+		abortRateLimited(c, org, repo, 1, retryAfter)
+		return
+	}
+
+	c.Next()
+}
+
+func persistDroppedCalls(counts map[tallyKey]int64) error {
+	rows := make([]DroppedCall, 0, len(counts))
+	for k, n := range counts {
+		rows = append(rows, DroppedCall{Organisation: k.organisation, Repository: k.repository, Day: k.day, Reason: k.label, Count: n})
+	}
+
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organisation"}, {Name: "repository"}, {Name: "day"}, {Name: "reason"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("dropped_calls.count + excluded.count")}),
+	}).Create(&rows).Error
+}
+
+// runRateLimitJobs periodically forgets idle rate limiters, and the expired
+// settings of the repositories calls were made to.
+func runRateLimitJobs(interval time.Duration) {
+	for range time.Tick(interval) {
+		originLimiters.cleanup(10 * time.Minute)
+		repoLimiters.cleanup(10 * time.Minute)
+		spoolLimiters.cleanup(10 * time.Minute)
+		schemaCache.cleanup()
+		scrubberCache.cleanup()
+		retentionCache.cleanup()
+		writeTokenCache.cleanup()
+	}
+}
+
+func getDroppedCalls(fq FilterQuery) ([]DroppedCall, error) {
+	dcs := []DroppedCall{}
+
+	if fq.Organisation == "" || fq.Repository == "" {
+		return dcs, fmt.Errorf("please specify organisation and repository")
+	}
+
+	gq := db.Where("organisation = ? AND repository = ?", fq.Organisation, fq.Repository)
+	if fq.FromDate != nil {
+		gq = gq.Where("day >= ?", time.Time(*fq.FromDate).Format(YYYYMMDDLayout))
+	}
+	if fq.ToDate != nil {
+		gq = gq.Where("day < ?", time.Time(*fq.ToDate).Format(YYYYMMDDLayout))
+	}
+
+	err := gq.Order("day asc, reason asc").Find(&dcs).Error
+	return dcs, err
+}
+
+// @Summary      Count dropped telemetry calls.
+// @Description  Count the calls that were not registered per day and reason, e.g. `rate_limited`.
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Param        from_date     query  string  false  "from date to filter on"
+// @Param        to_date       query  string  false  "to date to filter on"
+// @Produce      json
+// @Success      200  {object}  DroppedCountResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/count/dropped [get]
+func getDroppedCallsHandler(c *gin.Context) {
+	var fq FilterQuery
+	var or OrgRepoURI
+	resp := DroppedCountResp{}
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := bindFilterDates(c, &fq); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	fq.AddOrgRepo(or)
+	resp.Query = &fq
+
+	dcs, err := getDroppedCalls(fq)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	resp.Data = dcs
+	c.JSON(200, resp)
+}
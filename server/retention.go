@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// retentionPolicy is how long the raw calls of a repository are kept.
+type retentionPolicy struct {
+	days   int
+	rollup bool
+}
+
+func defaultRetentionPolicy() retentionPolicy {
+	return retentionPolicy{days: viper.GetInt("RETENTION_DAYS"), rollup: viper.GetBool("RETENTION_ROLLUP")}
+}
+
+// retentionCache holds the retention policy of repositories, for the
+// queries that depend on it.
+var retentionCache = newRepoCache(30 * time.Second)
+
+// of returns the policy of repository r, which overrides rp where it has
+// settings of its own.
+func (rp retentionPolicy) of(r Repository) retentionPolicy {
+	if r.RetentionDays != nil {
+		rp.days = *r.RetentionDays
+	}
+	if r.RollupExpired != nil {
+		rp.rollup = *r.RollupExpired
+	}
+	return rp
+}
+
+// retentionPolicies returns the default policy and the policies of the
+// repositories that override it, keyed by organisation/repository.
+func retentionPolicies() (retentionPolicy, map[string]retentionPolicy, error) {
+	def := defaultRetentionPolicy()
+
+	var rs []Repository
+	err := db.Where("retention_days IS NOT NULL OR rollup_expired IS NOT NULL").Find(&rs).Error
+	if err != nil {
+		return def, nil, err
+	}
+
+	overrides := map[string]retentionPolicy{}
+	for _, r := range rs {
+		overrides[r.Organisation+"/"+r.Repository] = def.of(r)
+	}
+
+	return def, overrides, nil
+}
+
+// retentionPolicyFor returns the retention policy of a repository.
+func retentionPolicyFor(org string, repo string) (retentionPolicy, error) {
+	v, err := retentionCache.get(org, repo, func() (interface{}, error) {
+		r, err := getRepository(org, repo)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return defaultRetentionPolicy(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return defaultRetentionPolicy().of(r), nil
+	})
+	if err != nil {
+		return retentionPolicy{}, err
+	}
+	return v.(retentionPolicy), nil
+}
+
+// purgeExpiredCalls removes the calls that are older than the retention of
+// their repository.
+func purgeExpiredCalls(now time.Time) error {
+	// spooled calls might be expired already, and need to be rolled up
+	if spoolPending() {
+		log.Info().Msg("not purging expired calls until the spooled calls are stored")
+		return nil
+	}
+	now = settledUntil(now)
+
+	def, overrides, err := retentionPolicies()
+	if err != nil {
+		return err
+	}
+
+	if viper.GetBool("PARTITION_CALLS") {
+		if err := dropExpiredPartitions(now, def, overrides); err != nil {
+			return err
+		}
+	}
+
+	// only repositories with calls older than the shortest retention can have expired calls
+	minDays := def.days
+	for _, rp := range overrides {
+		if rp.days > 0 && (minDays <= 0 || rp.days < minDays) {
+			minDays = rp.days
+		}
+	}
+	if minDays <= 0 {
+		return nil
+	}
+
+	// ClickHouse being down shouldn't keep calls in the database past their retention
+	if analyticsSink != nil && analyticsSink.ready() {
+		if err := analyticsSink.expireCalls(now, def, overrides); err != nil {
+			log.Error().Err(err).Msg("can't delete expired calls from clickhouse")
+		}
+	}
+
+	var repos []OrgRepoURI
+	err = db.Model(&Call{}).
+		Distinct("organisation", "repository").
+		Where("timestamp < ?", now.AddDate(0, 0, -minDays)).
+		Find(&repos).Error
+	if err != nil {
+		return err
+	}
+
+	loc, err := filterLocation(FilterQuery{})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range repos {
+		rp, ok := overrides[r.Organisation+"/"+r.Repository]
+		if !ok {
+			rp = def
+		}
+		if rp.days <= 0 {
+			continue
+		}
+
+		cutoff := now.In(loc).AddDate(0, 0, -rp.days).Format(YYYYMMDDLayout)
+		if err := expireCalls(r.Organisation, r.Repository, cutoff, rp.rollup); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expireRollups prepares the calls of a repository received before day
+// cutoff for deletion. With rollup the calls are rolled up so that they keep
+// being counted, without it their rollups are deleted as well.
+func expireRollups(org string, repo string, cutoff string, rollup bool) error {
+	if !rollup {
+		return db.Where("organisation = ? AND repository = ? AND day < ?", org, repo, cutoff).Delete(&CallRollup{}).Error
+	}
+
+	wm, err := getRollupWatermark(org, repo)
+	if err != nil {
+		return err
+	}
+	if wm >= cutoff {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return rollupDays(tx, org, repo, wm, cutoff)
+	})
+}
+
+// expireCalls deletes the calls of a repository received before day cutoff
+// in batches, so that the table isn't locked for long, see expireRollups.
+func expireCalls(org string, repo string, cutoff string, rollup bool) error {
+	if err := expireRollups(org, repo, cutoff, rollup); err != nil {
+		return err
+	}
+
+	until, err := dayStart(cutoff)
+	if err != nil {
+		return err
+	}
+
+	batch := viper.GetInt("RETENTION_BATCH_SIZE")
+	if batch <= 0 {
+		batch = 10000
+	}
+	for {
+		var ids []uint
+		err := db.Model(&Call{}).Where("organisation = ? AND repository = ? AND timestamp < ?", org, repo, until).
+			Limit(batch).Pluck("id", &ids).Error
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := deleteCallAttributes(tx, ids); err != nil {
+				return err
+			}
+			return tx.Where("id IN ?", ids).Delete(&Call{}).Error
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Debug().Msgf("purged %d calls of %s/%s", len(ids), org, repo)
+		if len(ids) < batch {
+			return nil
+		}
+	}
+}
+
+// runRetentionJanitor periodically purges expired calls.
+func runRetentionJanitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := purgeExpiredCalls(time.Now()); err != nil {
+			log.Error().Err(err).Msg("can't purge expired calls")
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// rollupAllEvents is the event of the rollups that count all events, event
+// names can't contain it.
+const rollupAllEvents = "*"
+
+// rollupSQL rolls up the calls of a repository received in a time range per
+// day, event and payload key. Grouping sets add the rollups of all events.
+const rollupSQL = `
+INSERT INTO call_rollups (organisation, repository, day, event, key, count, origins)
+SELECT @org, @repo, day, coalesce(event, @all), coalesce(key, ''), count(*), count(distinct origin)
+FROM (
+	SELECT to_char(timestamp AT TIME ZONE @tz, 'YYYY-MM-DD') AS day, event, origin, NULL AS key
+	FROM calls
+	WHERE organisation = @org AND repository = @repo AND timestamp >= @from AND timestamp < @until
+	UNION ALL
+	SELECT to_char(timestamp AT TIME ZONE @tz, 'YYYY-MM-DD'), event, origin, k.key
+	FROM calls, jsonb_object_keys(payload) AS k(key)
+	WHERE organisation = @org AND repository = @repo AND timestamp >= @from AND timestamp < @until
+		AND jsonb_typeof(payload) = 'object' AND k.key <> ''
+) AS c
+GROUP BY GROUPING SETS ((day, event, key), (day, key))
+ON CONFLICT (organisation, repository, day, event, key)
+DO UPDATE SET count = excluded.count, origins = excluded.origins`
+
+// dayStart is the start of a YYYY-MM-DD day in the timezone of the server.
+func dayStart(day string) (time.Time, error) {
+	loc, err := filterLocation(FilterQuery{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.ParseInLocation(YYYYMMDDLayout, day, loc)
+}
+
+// rollupDays rolls up the calls of a repository from day from up to, but
+// not including, day until and moves its watermark to until. An empty from
+// starts at the first call. Days are complete once they are over as calls
+// are always received now, so rolling up a day again gives the same result.
+func rollupDays(tx *gorm.DB, org string, repo string, from string, until string) error {
+	loc, err := filterLocation(FilterQuery{})
+	if err != nil {
+		return err
+	}
+
+	var fromTime time.Time
+	if from != "" {
+		if fromTime, err = dayStart(from); err != nil {
+			return err
+		}
+	}
+	untilTime, err := dayStart(until)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Exec(rollupSQL, map[string]interface{}{
+		"org": org, "repo": repo, "all": rollupAllEvents, "tz": loc.String(), "from": fromTime, "until": untilTime,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	// the watermark never moves back
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organisation"}, {Name: "repository"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"day": gorm.Expr("greatest(rollup_watermarks.day, excluded.day)")}),
+	}).Create(&RollupWatermark{Organisation: org, Repository: repo, Day: until}).Error
+}
+
+// settledUntil is now, or the receive time of the oldest queued call that
+// isn't stored yet when that is earlier. Calls received before it are stored.
+func settledUntil(now time.Time) time.Time {
+	if since, ok := ingestPendingSince(); ok && since.Before(now) {
+		return since
+	}
+	return now
+}
+
+// rollupCompleteDays rolls up the days before today of all repositories with
+// calls that are not rolled up yet. Days aren't complete while spooled or
+// queued calls of them wait to be stored, as rolled up days are never rolled
+// up again.
+func rollupCompleteDays(now time.Time) error {
+	if spoolPending() {
+		log.Info().Msg("not rolling up calls until the spooled calls are stored")
+		return nil
+	}
+	now = settledUntil(now)
+
+	loc, err := filterLocation(FilterQuery{})
+	if err != nil {
+		return err
+	}
+
+	today := now.In(loc).Format(YYYYMMDDLayout)
+	todayStart, err := dayStart(today)
+	if err != nil {
+		return err
+	}
+
+	var pending []struct {
+		Organisation string
+		Repository   string
+		Day          *string
+	}
+	err = db.Raw(`
+		SELECT DISTINCT c.organisation, c.repository, w.day
+		FROM calls c
+		LEFT JOIN rollup_watermarks w ON w.organisation = c.organisation AND w.repository = c.repository
+		WHERE c.timestamp < @today AND (w.day IS NULL OR c.timestamp >= w.day::date::timestamp AT TIME ZONE @tz)`,
+		map[string]interface{}{"today": todayStart, "tz": loc.String()}).
+		Scan(&pending).Error
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pending {
+		from := ""
+		if p.Day != nil {
+			from = *p.Day
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return rollupDays(tx, p.Organisation, p.Repository, from, today)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runRollupJob periodically rolls up the days that are over.
+func runRollupJob(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := rollupCompleteDays(time.Now()); err != nil {
+			log.Error().Err(err).Msg("can't roll up calls")
+		}
+	}
+}
+
+func getRollupWatermark(org string, repo string) (string, error) {
+	var wm RollupWatermark
+	err := db.Where("organisation = ? AND repository = ?", org, repo).First(&wm).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	return wm.Day, err
+}
+
+// rollupUsable reports whether the counts of fq can come from the rollups,
+// which are only kept per day in the timezone of the server and can only
+// filter on event and key. Distinct origins of several days only add up
+// when origins rotate at least daily, otherwise the same origin is counted
+// once for every day it called.
+func rollupUsable(fq FilterQuery) bool {
+	if len(fq.Where) > 0 || fq.GroupBy != "" || fq.TimeField == timeFieldClient {
+		return false
+	}
+	if fq.Unique && originSaltRotation > 24*time.Hour {
+		return false
+	}
+
+	if fq.TZ != "" {
+		loc, err := filterLocation(fq)
+		serverLoc, serverErr := filterLocation(FilterQuery{})
+		if err != nil || serverErr != nil || loc.String() != serverLoc.String() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rollupWatermark returns the watermark of the repository of fq if its
+// counts can come from the rollups, an empty string otherwise. Calls before
+// the watermark are then counted from the rollups, later calls from the calls table.
+func rollupWatermark(fq FilterQuery) (string, error) {
+	if !rollupUsable(fq) {
+		return "", nil
+	}
+	return getRollupWatermark(fq.Organisation, fq.Repository)
+}
+
+// rollupQueryBuilder selects the rollups of fq before watermark wm, of all
+// events together unless fq filters on an event.
+func rollupQueryBuilder(fq FilterQuery, wm string) *gorm.DB {
+	event := fq.Event
+	if event == "" {
+		event = rollupAllEvents
+	}
+	return rollupDaysQueryBuilder(fq, wm).Where("event = ?", event)
+}
+
+// rollupDaysQueryBuilder selects the rollups of fq before watermark wm,
+// without filtering on event.
+func rollupDaysQueryBuilder(fq FilterQuery, wm string) *gorm.DB {
+	gq := db.Model(&CallRollup{}).Where("organisation = ? AND repository = ? AND key = ? AND day < ?",
+		fq.Organisation, fq.Repository, fq.Key, wm)
+
+	if fq.FromDate != nil {
+		gq = gq.Where("day >= ?", time.Time(*fq.FromDate).Format(YYYYMMDDLayout))
+	}
+	if fq.ToDate != nil {
+		gq = gq.Where("day < ?", time.Time(*fq.ToDate).Format(YYYYMMDDLayout))
+	}
+
+	return gq
+}
+
+// rollupCountColumn is the rollup column that counts what fq asks for. Summed
+// over several days distinct origins are an estimate, origins rotate at
+// least daily when rollups are used for them.
+func rollupCountColumn(fq FilterQuery) string {
+	if fq.Unique {
+		return "origins"
+	}
+	return "count"
+}
+
+// sinceWatermark limits a calls query to the calls that are not rolled up.
+func sinceWatermark(gq *gorm.DB, wm string) (*gorm.DB, error) {
+	t, err := dayStart(wm)
+	if err != nil {
+		return gq, err
+	}
+	return gq.Where("timestamp >= ?", t), nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	schemaModeReport = "report"
+	schemaModeReject = "reject"
+
+	schemaTypeString  = "string"
+	schemaTypeNumber  = "number"
+	schemaTypeBoolean = "boolean"
+	schemaTypeArray   = "array"
+
+	violationUnknownKey = "unknown_key"
+	violationWrongType  = "wrong_type"
+	violationNotInEnum  = "not_in_enum"
+	violationTooLong    = "too_long"
+	violationMissing    = "missing"
+
+	dropReasonSchema = "schema_violation"
+)
+
+var (
+	errNoSchema = errors.New("no schema registered for this repository")
+
+	schemaViolations = newDailyTally(persistSchemaViolations)
+	schemaCache      = newRepoCache(30 * time.Second)
+)
+
+// validateSchema checks a schema before it is registered.
+func validateSchema(s PayloadSchema) error {
+	if s.Mode != schemaModeReport && s.Mode != schemaModeReject {
+		return fmt.Errorf("unknown mode '%s', use %s or %s", s.Mode, schemaModeReport, schemaModeReject)
+	}
+	if len(s.Keys) == 0 {
+		return fmt.Errorf("a schema needs at least one key")
+	}
+
+	for k, sk := range s.Keys {
+		switch sk.Type {
+		case schemaTypeString, schemaTypeNumber, schemaTypeBoolean, schemaTypeArray:
+		default:
+			return fmt.Errorf("key '%s' has unknown type '%s'", k, sk.Type)
+		}
+		if sk.MaxLength < 0 || (sk.MaxLength > 0 && sk.Type != schemaTypeString) {
+			return fmt.Errorf("key '%s' can't have max_length %d", k, sk.MaxLength)
+		}
+		for _, v := range sk.Enum {
+			valid := schemaTypeMatches(sk.Type, v)
+			if sk.Type == schemaTypeArray {
+				// the items of arrays are checked against the enum
+				valid = isScalar(v)
+			}
+			if !valid {
+				return fmt.Errorf("enum value %v of key '%s' is not a %s", v, k, sk.Type)
+			}
+		}
+	}
+
+	return nil
+}
+
+func schemaTypeMatches(t string, v interface{}) bool {
+	switch v.(type) {
+	case string:
+		return t == schemaTypeString
+	case float64:
+		return t == schemaTypeNumber
+	case bool:
+		return t == schemaTypeBoolean
+	case []interface{}:
+		return t == schemaTypeArray
+	}
+	return false
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, float64, bool:
+		return true
+	}
+	return false
+}
+
+func inEnum(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		// enum values are scalars, see validateSchema
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPayloadSchema lists the keys of pl that don't match s, sorted by key.
+func checkPayloadSchema(pl CallPayload, s PayloadSchema) []KeyIssue {
+	issues := []KeyIssue{}
+
+	for k, v := range pl {
+		sk, ok := s.Keys[k]
+		if !ok {
+			issues = append(issues, KeyIssue{k, violationUnknownKey})
+			continue
+		}
+
+		if v == nil && sk.Nullable {
+			continue
+		}
+
+		if !schemaTypeMatches(sk.Type, v) {
+			issues = append(issues, KeyIssue{k, violationWrongType})
+			continue
+		}
+
+		if len(sk.Enum) > 0 {
+			found := true
+			if items, ok := v.([]interface{}); ok {
+				for _, item := range items {
+					found = found && isScalar(item) && inEnum(sk.Enum, item)
+				}
+			} else {
+				found = inEnum(sk.Enum, v)
+			}
+			if !found {
+				issues = append(issues, KeyIssue{k, violationNotInEnum})
+				continue
+			}
+		}
+
+		if str, ok := v.(string); ok && sk.MaxLength > 0 && utf8.RuneCountInString(str) > sk.MaxLength {
+			issues = append(issues, KeyIssue{k, violationTooLong})
+		}
+	}
+
+	for k, sk := range s.Keys {
+		if _, ok := pl[k]; sk.Required && !ok {
+			issues = append(issues, KeyIssue{k, violationMissing})
+		}
+	}
+
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Key < issues[j].Key })
+	return issues
+}
+
+// getPayloadSchema returns the schema of a repository, nil if it has none.
+func getPayloadSchema(org string, repo string) (*PayloadSchema, error) {
+	v, err := schemaCache.get(org, repo, func() (interface{}, error) {
+		var rs RepositorySchema
+		err := db.Where("organisation = ? AND repository = ?", org, repo).First(&rs).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return (*PayloadSchema)(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ps := &PayloadSchema{}
+		return ps, json.Unmarshal(rs.Schema, ps)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*PayloadSchema), nil
+}
+
+func putPayloadSchema(org string, repo string, s PayloadSchema) error {
+	if err := validateSchema(s); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	rs := RepositorySchema{Organisation: org, Repository: repo, Schema: b, UpdatedAt: time.Now()}
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organisation"}, {Name: "repository"}},
+		DoUpdates: clause.AssignmentColumns([]string{"schema", "updated_at"}),
+	}).Create(&rs).Error
+
+	schemaCache.forget(org, repo)
+	return err
+}
+
+func deletePayloadSchema(org string, repo string) (bool, error) {
+	result := db.Where("organisation = ? AND repository = ?", org, repo).Delete(&RepositorySchema{})
+	schemaCache.forget(org, repo)
+	return result.RowsAffected > 0, result.Error
+}
+
+// enforcePayloadSchema checks the payload of a call against the schema of
+// its repository, if there is one. Violations are counted in both modes,
+// in reject mode they also fail the call.
+func enforcePayloadSchema(c *Call, pl CallPayload) error {
+	s, err := getPayloadSchema(c.Organisation, c.Repository)
+	if err != nil || s == nil {
+		return err
+	}
+
+	issues := checkPayloadSchema(pl, *s)
+	if len(issues) == 0 {
+		return nil
+	}
+
+	for _, ki := range issues {
+		schemaViolations.add(c.Organisation, c.Repository, ki.Key, ki.Reason, 1)
+	}
+
+	if s.Mode != schemaModeReject {
+		return nil
+	}
+
+	droppedCalls.add(c.Organisation, c.Repository, dropReasonSchema, "", 1)
+	return fmt.Errorf("payload doesn't match the schema: %s", describeKeyIssues(issues))
+}
+
+func describeKeyIssues(issues []KeyIssue) string {
+	msgs := make([]string, len(issues))
+	for i, ki := range issues {
+		msgs[i] = fmt.Sprintf("'%s' %s", ki.Key, ki.Reason)
+	}
+	return strings.Join(msgs, ", ")
+}
+
+func persistSchemaViolations(counts map[tallyKey]int64) error {
+	rows := make([]SchemaViolation, 0, len(counts))
+	for k, n := range counts {
+		rows = append(rows, SchemaViolation{Organisation: k.organisation, Repository: k.repository, Day: k.day, Key: k.label, Reason: k.detail, Count: n})
+	}
+
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organisation"}, {Name: "repository"}, {Name: "day"}, {Name: "key"}, {Name: "reason"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("schema_violations.count + excluded.count")}),
+	}).Create(&rows).Error
+}
+
+func getSchemaViolations(fq FilterQuery) ([]SchemaViolation, error) {
+	svs := []SchemaViolation{}
+
+	if fq.Organisation == "" || fq.Repository == "" {
+		return svs, fmt.Errorf("please specify organisation and repository")
+	}
+
+	gq := db.Where("organisation = ? AND repository = ?", fq.Organisation, fq.Repository)
+	if fq.Key != "" {
+		gq = gq.Where("key = ?", fq.Key)
+	}
+	if fq.FromDate != nil {
+		gq = gq.Where("day >= ?", time.Time(*fq.FromDate).Format(YYYYMMDDLayout))
+	}
+	if fq.ToDate != nil {
+		gq = gq.Where("day < ?", time.Time(*fq.ToDate).Format(YYYYMMDDLayout))
+	}
+
+	err := gq.Order("day asc, key asc, reason asc").Find(&svs).Error
+	return svs, err
+}
+
+// @Summary      Get the payload schema of a repository.
+// @Param        organisation  path   string  true  "github organisation"
+// @Param        repository    path   string  true  "repository name"
+// @Produce      json
+// @Success      200  {object}  SchemaResp
+// @Failure      404  {object}  SchemaResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/schema [get]
+func getSchemaHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var resp SchemaResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	s, err := getPayloadSchema(or.Organisation, or.Repository)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	if s == nil {
+		resp.Error = errNoSchema.Error()
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+
+	resp.Data = s
+	c.JSON(200, resp)
+}
+
+// @Summary      Register the payload schema of a repository.
+// @Description  Register the keys that payloads of a repository can have, replacing the current schema.
+// @Description  Each key has a `type` (`string`, `number`, `boolean` or `array`) and optionally an `enum` of allowed values,
+// @Description  which for arrays applies to their items, a `max_length` for strings and whether it is `required`. Unknown keys are violations.
+// @Description  In `report` mode calls that violate the schema are still registered, in `reject` mode they are refused.
+// @Description  Either way violations are counted, see `/schema/violations`. Requires an admin token.
+// @Accept       json
+// @Param        organisation  path   string         true  "github organisation"
+// @Param        repository    path   string         true  "repository name"
+// @Param        schema        body   PayloadSchema  true  "payload schema"
+// @Produce      json
+// @Success      200  {object}  SchemaResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/schema [put]
+func putSchemaHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var s PayloadSchema
+	var resp SchemaResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.ShouldBindJSON(&s); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := putPayloadSchema(or.Organisation, or.Repository, s); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	resp.Data = &s
+	c.JSON(200, resp)
+}
+
+// @Summary      Remove the payload schema of a repository.
+// @Description  Remove the payload schema so that all payloads are accepted again. Requires an admin token.
+// @Param        organisation  path   string  true  "github organisation"
+// @Param        repository    path   string  true  "repository name"
+// @Produce      json
+// @Success      200  {object}  DefaultResp
+// @Failure      404  {object}  DefaultResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/schema [delete]
+func deleteSchemaHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var resp DefaultResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	deleted, err := deletePayloadSchema(or.Organisation, or.Repository)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	if !deleted {
+		resp.Error = errNoSchema.Error()
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+
+	c.JSON(200, resp)
+}
+
+// @Summary      Count schema violations.
+// @Description  Count per day how often payload keys violated the schema of the repository, per reason:
+// @Description  `unknown_key`, `wrong_type`, `not_in_enum`, `too_long` or `missing`.
+// @Param        organisation  path   string  true   "github organisation"
+// @Param        repository    path   string  true   "repository name"
+// @Param        key           query  string  false  "only count violations of this key"
+// @Param        from_date     query  string  false  "from date to filter on"
+// @Param        to_date       query  string  false  "to date to filter on"
+// @Produce      json
+// @Success      200  {object}  SchemaViolationsResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/schema/violations [get]
+func getSchemaViolationsHandler(c *gin.Context) {
+	var fq FilterQuery
+	var or OrgRepoURI
+	resp := SchemaViolationsResp{}
+
+	if err := c.ShouldBind(&fq); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := bindFilterDates(c, &fq); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	fq.AddOrgRepo(or)
+	resp.Query = &fq
+
+	svs, err := getSchemaViolations(fq)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+	resp.Data = svs
+	c.JSON(200, resp)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	detectorEmail    = "email"
+	detectorIP       = "ip"
+	detectorHomePath = "home_path"
+	detectorAPIKey   = "api_key"
+
+	defaultScrubReplacement = "[redacted]"
+	maxScrubRules           = 20
+)
+
+// scrubRule is a compiled ScrubRule.
+type scrubRule struct {
+	name        string
+	re          *regexp.Regexp
+	replacement string
+}
+
+// scrubber masks personal information in payloads by applying its rules in order.
+type scrubber struct {
+	rules []scrubRule
+}
+
+var (
+	errNoScrubConfig = errors.New("no scrubbing configured for this repository")
+
+	// builtinDetectors are applied in this order, secrets first as they can
+	// contain something that looks like an email address.
+	builtinDetectors = []scrubRule{
+		{detectorAPIKey, regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{20,}|github_pat_[A-Za-z0-9_]{20,}|glpat-[A-Za-z0-9_-]{20,}|sk-[A-Za-z0-9_-]{20,}|xox[abposr]-[A-Za-z0-9-]{10,}|AKIA[0-9A-Z]{16}|AIza[0-9A-Za-z_-]{35})`), "[secret]"},
+		{detectorAPIKey, regexp.MustCompile(`(?i)\b((?:api[_-]?key|token|secret|password|passwd)\s*[=:]\s*)[^\s&,;]+`), "${1}[secret]"},
+		{detectorEmail, regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[email]"},
+		{detectorHomePath, regexp.MustCompile(`(/home/|/Users/|(?i:[a-z]:\\Users\\))[^/\\\s]+`), "${1}[user]"},
+		{detectorIP, regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`), "[ip]"},
+		{detectorIP, regexp.MustCompile(`(?i)\b(?:[0-9a-f]{1,4}:){7}[0-9a-f]{1,4}\b|\b(?:[0-9a-f]{1,4}:){1,6}(?::[0-9a-f]{1,4}){1,6}\b`), "[ip]"},
+	}
+
+	// defaultDetectors and serverScrubRules apply to every repository
+	// unless its ScrubConfig says otherwise.
+	defaultDetectors = []string{detectorEmail, detectorIP, detectorHomePath, detectorAPIKey}
+	serverScrubRules []scrubRule
+
+	scrubberCache = newRepoCache(30 * time.Second)
+)
+
+// loadScrubRules reads the detectors that are enabled by default and the
+// rules of the server, e.g.
+//
+//	PII_DETECTORS: email,home_path
+//	PII_RULES:
+//	  - name: customer_id
+//	    pattern: CUST-[0-9]{6}
+//	    replacement: CUST-XXXXXX
+func loadScrubRules() {
+	defaultDetectors = []string{}
+	for _, d := range viper.GetStringSlice("PII_DETECTORS") {
+		for _, name := range strings.Split(d, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				defaultDetectors = append(defaultDetectors, name)
+			}
+		}
+	}
+	if _, err := newScrubber(ScrubConfig{Detectors: &defaultDetectors}); err != nil {
+		log.Warn().Err(err).Msg("invalid PII_DETECTORS, falling back to all detectors")
+		defaultDetectors = []string{detectorEmail, detectorIP, detectorHomePath, detectorAPIKey}
+	}
+
+	var rules []ScrubRule
+	if err := viper.UnmarshalKey("PII_RULES", &rules); err != nil {
+		log.Warn().Err(err).Msg("can't read PII_RULES")
+	}
+
+	serverScrubRules = nil
+	for _, r := range rules {
+		sr, err := compileScrubRule(r)
+		if err != nil {
+			log.Warn().Err(err).Msgf("skipping PII rule '%s'", r.Name)
+			continue
+		}
+		serverScrubRules = append(serverScrubRules, sr)
+	}
+}
+
+func compileScrubRule(r ScrubRule) (scrubRule, error) {
+	if r.Name == "" {
+		return scrubRule{}, fmt.Errorf("scrub rules need a name")
+	}
+
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return scrubRule{}, fmt.Errorf("invalid pattern for rule '%s': %w", r.Name, err)
+	}
+
+	if r.Replacement == "" {
+		r.Replacement = defaultScrubReplacement
+	}
+	return scrubRule{r.Name, re, r.Replacement}, nil
+}
+
+// newScrubber compiles the rules of sc, falling back to the defaults of the
+// server for what it doesn't set.
+func newScrubber(sc ScrubConfig) (*scrubber, error) {
+	detectors := defaultDetectors
+	if sc.Detectors != nil {
+		detectors = *sc.Detectors
+	}
+
+	enabled := map[string]bool{}
+	for _, d := range detectors {
+		known := false
+		for _, bd := range builtinDetectors {
+			known = known || bd.name == d
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown detector '%s'", d)
+		}
+		enabled[d] = true
+	}
+
+	if len(sc.Rules) > maxScrubRules {
+		return nil, fmt.Errorf("at most %d rules are allowed", maxScrubRules)
+	}
+
+	s := &scrubber{}
+	for _, bd := range builtinDetectors {
+		if enabled[bd.name] {
+			s.rules = append(s.rules, bd)
+		}
+	}
+	s.rules = append(s.rules, serverScrubRules...)
+	for _, r := range sc.Rules {
+		sr, err := compileScrubRule(r)
+		if err != nil {
+			return nil, err
+		}
+		s.rules = append(s.rules, sr)
+	}
+
+	return s, nil
+}
+
+// scrubString returns v with the matches of all rules masked, and how many
+// matches were masked.
+func (s *scrubber) scrubString(v string) (string, int) {
+	var n int
+	for _, r := range s.rules {
+		if m := len(r.re.FindAllStringIndex(v, -1)); m > 0 {
+			n += m
+			v = r.re.ReplaceAllString(v, r.replacement)
+		}
+	}
+	return v, n
+}
+
+// scrub masks the string values of pl in place, including those in arrays,
+// and returns the number of redactions.
+func (s *scrubber) scrub(pl CallPayload) int {
+	var n int
+	for k, v := range pl {
+		switch v := v.(type) {
+		case string:
+			var m int
+			pl[k], m = s.scrubString(v)
+			n += m
+		case []interface{}:
+			for i, item := range v {
+				if str, ok := item.(string); ok {
+					var m int
+					v[i], m = s.scrubString(str)
+					n += m
+				}
+			}
+		}
+	}
+	return n
+}
+
+func getScrubConfig(org string, repo string) (*ScrubConfig, error) {
+	var rs RepositoryScrubbing
+	err := db.Where("organisation = ? AND repository = ?", org, repo).First(&rs).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &ScrubConfig{}
+	return sc, json.Unmarshal(rs.Config, sc)
+}
+
+// scrubberFor returns the scrubber for the payloads of a repository.
+func scrubberFor(org string, repo string) (*scrubber, error) {
+	v, err := scrubberCache.get(org, repo, func() (interface{}, error) {
+		sc, err := getScrubConfig(org, repo)
+		if err != nil {
+			return nil, err
+		}
+		if sc == nil {
+			sc = &ScrubConfig{}
+		}
+		return newScrubber(*sc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*scrubber), nil
+}
+
+func putScrubConfig(org string, repo string, sc ScrubConfig) error {
+	if _, err := newScrubber(sc); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+
+	rs := RepositoryScrubbing{Organisation: org, Repository: repo, Config: b, UpdatedAt: time.Now()}
+	err = db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "organisation"}, {Name: "repository"}},
+		DoUpdates: clause.AssignmentColumns([]string{"config", "updated_at"}),
+	}).Create(&rs).Error
+
+	scrubberCache.forget(org, repo)
+	return err
+}
+
+func deleteScrubConfig(org string, repo string) (bool, error) {
+	result := db.Where("organisation = ? AND repository = ?", org, repo).Delete(&RepositoryScrubbing{})
+	scrubberCache.forget(org, repo)
+	return result.RowsAffected > 0, result.Error
+}
+
+// @Summary      Get the PII scrubbing configuration of a repository.
+// @Param        organisation  path   string  true  "github organisation"
+// @Param        repository    path   string  true  "repository name"
+// @Produce      json
+// @Success      200  {object}  ScrubConfigResp
+// @Failure      404  {object}  ScrubConfigResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/scrubbing [get]
+func getScrubConfigHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var resp ScrubConfigResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	sc, err := getScrubConfig(or.Organisation, or.Repository)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	if sc == nil {
+		resp.Error = errNoScrubConfig.Error()
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+
+	resp.Data = sc
+	c.JSON(200, resp)
+}
+
+// @Summary      Configure PII scrubbing for a repository.
+// @Description  String values in payloads are scrubbed of personal information before they are stored,
+// @Description  every masked match is counted in the `redactions` of the response.
+// @Description  `detectors` picks the built-in detectors to use: `email`, `ip`, `home_path` (the user name in home directories)
+// @Description  and `api_key`. Leave it out to use the detectors the server enables by default.
+// @Description  `rules` are extra regular expressions, their matches are replaced by `replacement` or `[redacted]`.
+// @Description  Requires an admin token.
+// @Accept       json
+// @Param        organisation  path   string       true  "github organisation"
+// @Param        repository    path   string       true  "repository name"
+// @Param        config        body   ScrubConfig  true  "scrubbing configuration"
+// @Produce      json
+// @Success      200  {object}  ScrubConfigResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/scrubbing [put]
+func putScrubConfigHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var sc ScrubConfig
+	var resp ScrubConfigResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := c.ShouldBindJSON(&sc); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	if err := putScrubConfig(or.Organisation, or.Repository, sc); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	resp.Data = &sc
+	c.JSON(200, resp)
+}
+
+// @Summary      Remove the PII scrubbing configuration of a repository.
+// @Description  Go back to the scrubbing defaults of the server. Requires an admin token.
+// @Param        organisation  path   string  true  "github organisation"
+// @Param        repository    path   string  true  "repository name"
+// @Produce      json
+// @Success      200  {object}  DefaultResp
+// @Failure      404  {object}  DefaultResp
+// @Security     BearerAuth
+// @Router       /{organisation}/{repository}/scrubbing [delete]
+func deleteScrubConfigHandler(c *gin.Context) {
+	var or OrgRepoURI
+	var resp DefaultResp
+
+	if err := c.ShouldBindUri(&or); err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusBadRequest, resp)
+		return
+	}
+
+	deleted, err := deleteScrubConfig(or.Organisation, or.Repository)
+	if err != nil {
+		resp.Error = err.Error()
+		c.JSON(http.StatusInternalServerError, resp)
+		return
+	}
+	if !deleted {
+		resp.Error = errNoScrubConfig.Error()
+		c.JSON(http.StatusNotFound, resp)
+		return
+	}
+
+	c.JSON(200, resp)
+}
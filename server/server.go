@@ -11,9 +11,26 @@ import (
 var (
 	db                 *gorm.DB
 	checkRepoExistence bool
+	githubAPIURL       string
 )
 
-const getCallsLimit = 3000
+const (
+	clientTimestampKey    = "_ts"
+	clientTimestampHeader = "X-Phonehome-Timestamp"
+	clientTsClamp         = "clamp"
+	clientTsReject        = "reject"
+	timeFieldServer       = "server"
+	timeFieldClient       = "client"
+
+	stripNestedObject   = "nested_object"
+	stripArrayTooLong   = "array_too_long"
+	stripArrayNotScalar = "array_not_scalar"
+	stripUnsupported    = "unsupported"
+
+	getCallsLimit    = 3000
+	maxSeriesBuckets = 5000
+	seriesBucketKey  = "2006-01-02T15"
+)
 
 func buildServer() *gin.Engine {
 	r := gin.Default()
@@ -22,12 +39,40 @@ func buildServer() *gin.Engine {
 	config.AllowOrigins = []string{"http://localhost:8080", "https://phonehome.dev"}
 	r.Use(cors.New(config))
 
-	r.GET("/:organisation/:repository/count/daily", getCountCallsByDayHandler)
-	r.GET("/:organisation/:repository/count/badge", getCountCallsBadgeHandler)
-	r.GET("/:organisation/:repository/count", getCountCallsHandler)
-	r.GET("/:organisation/:repository", getCallsHandler)
+	read := repoTokenMW(scopeRead)
+	r.GET("/info", infoHandler)
+
+	r.GET("/:organisation/:repository/count/daily", read, getCountCallsByDayHandler)
+	r.GET("/:organisation/:repository/count/series", read, getCountCallsSeriesHandler)
+	r.GET("/:organisation/:repository/count/badge", repoTokenMW(scopeBadge), getCountCallsBadgeHandler)
+	r.GET("/:organisation/:repository/count/unique", read, getCountUniqueHandler)
+	r.GET("/:organisation/:repository/count/dropped", read, getDroppedCallsHandler)
+	r.GET("/:organisation/:repository/count/events", read, getCountCallsByEventHandler)
+	r.GET("/:organisation/:repository/count", read, getCountCallsHandler)
+	r.GET("/:organisation/:repository", read, getCallsHandler)
+	r.GET("/:organisation/:repository/schema", read, getSchemaHandler)
+	r.GET("/:organisation/:repository/schema/violations", read, getSchemaViolationsHandler)
+	r.GET("/:organisation/:repository/scrubbing", read, getScrubConfigHandler)
+
+	write := repoTokenMW(scopeWrite)
+	r.POST("/:organisation/:repository", spoolMW, originRateLimitMW, githubRepoExistsMW, write, repoRateLimitMW, registerCallHander)
+	r.POST("/:organisation/:repository/batch", spoolMW, originRateLimitMW, githubRepoExistsMW, write, repoRateLimitMW, registerBatchHandler)
+	r.POST("/:organisation/:repository/e/:event", spoolMW, originRateLimitMW, githubRepoExistsMW, write, repoRateLimitMW, registerCallHander)
+	r.POST("/:organisation/:repository/e/:event/batch", spoolMW, originRateLimitMW, githubRepoExistsMW, write, repoRateLimitMW, registerBatchHandler)
+
+	r.POST("/:organisation/:repository/claim", githubRepoExistsMW, claimHandler)
+	r.POST("/:organisation/:repository/claim/verify", verifyClaimHandler)
 
-	r.POST("/:organisation/:repository", githubRepoExistsMW, registerCallHander)
+	admin := repoTokenMW(scopeAdmin)
+	r.GET("/:organisation/:repository/tokens", admin, getTokensHandler)
+	r.POST("/:organisation/:repository/tokens", admin, createTokenHandler)
+	r.DELETE("/:organisation/:repository/tokens/:id", admin, deleteTokenHandler)
+	r.GET("/:organisation/:repository/settings", admin, getSettingsHandler)
+	r.PATCH("/:organisation/:repository/settings", admin, updateSettingsHandler)
+	r.PUT("/:organisation/:repository/schema", admin, putSchemaHandler)
+	r.DELETE("/:organisation/:repository/schema", admin, deleteSchemaHandler)
+	r.PUT("/:organisation/:repository/scrubbing", admin, putScrubConfigHandler)
+	r.DELETE("/:organisation/:repository/scrubbing", admin, deleteScrubConfigHandler)
 
 	r.StaticFile("/docs/swagger.json", "./docs/swagger.json")
 
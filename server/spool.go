@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	spoolSegmentExt   = ".spool"
+	spoolPositionFile = "replay.pos"
+
+	dropReasonSpoolFull    = "spool_full"
+	dropReasonUnauthorized = "unauthorized"
+	dropReasonInvalid      = "invalid"
+)
+
+var (
+	errSpoolFull     = errors.New("the spool is full")
+	errDBUnavailable = errors.New("the database is unavailable")
+)
+
+var (
+	// callSpool keeps calls on disk while the database is unavailable, nil
+	// when SPOOL_DIR isn't set
+	callSpool *spool
+	// dbDown is 1 while the database is unreachable
+	dbDown int32
+)
+
+// spool is a write-ahead log of calls, split in segment files of about
+// SPOOL_SEGMENT_BYTES. Records are appended to the newest segment and
+// replayed oldest first, segments that are replayed are removed.
+type spool struct {
+	sync.Mutex
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+	seq          int64
+	size         int64
+	cur          *os.File
+	curSize      int64
+}
+
+// spoolRecord is either a request that came in while the database was down,
+// to be handled like the original once it is back, or a call that was
+// accepted but couldn't be stored.
+type spoolRecord struct {
+	Request *spooledRequest `json:"request,omitempty"`
+	Call    *Call           `json:"call,omitempty"`
+}
+
+// spooledRequest keeps what registering a call needs from its request. The
+// client IP is only kept as the origin hash, see spoolOrigin, and the token
+// only as its hash.
+type spooledRequest struct {
+	Organisation    string    `json:"organisation"`
+	Repository      string    `json:"repository"`
+	Event           string    `json:"event,omitempty"`
+	Batch           bool      `json:"batch,omitempty"`
+	Body            string    `json:"body"`
+	ClientTimestamp string    `json:"client_timestamp,omitempty"`
+	Origin          string    `json:"origin"`
+	TokenHash       string    `json:"token_hash,omitempty"`
+	ReceivedAt      time.Time `json:"received_at"`
+}
+
+func openSpool(dir string, segmentBytes int64, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	sp := &spool{dir: dir, segmentBytes: segmentBytes, maxBytes: maxBytes}
+	segs, err := sp.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range segs {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		sp.size += fi.Size()
+		// the last segment might end in a torn write, new records go to a new one
+		if seq, err := strconv.ParseInt(strings.TrimSuffix(name, spoolSegmentExt), 10, 64); err == nil && seq > sp.seq {
+			sp.seq = seq
+		}
+	}
+
+	return sp, nil
+}
+
+// segments returns the names of the segments, oldest first.
+func (sp *spool) segments() ([]string, error) {
+	entries, err := os.ReadDir(sp.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segs []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), spoolSegmentExt) {
+			segs = append(segs, e.Name())
+		}
+	}
+	// names are zero padded sequence numbers
+	sort.Strings(segs)
+	return segs, nil
+}
+
+func (sp *spool) empty() bool {
+	sp.Lock()
+	defer sp.Unlock()
+	return sp.size == 0
+}
+
+// append writes records to the spool and syncs them to disk. Records that
+// would grow the spool beyond SPOOL_MAX_BYTES are refused with errSpoolFull.
+func (sp *spool) append(records []spoolRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	sp.Lock()
+	defer sp.Unlock()
+
+	if sp.maxBytes > 0 && sp.size+int64(buf.Len()) > sp.maxBytes {
+		return errSpoolFull
+	}
+
+	if sp.cur == nil || sp.curSize >= sp.segmentBytes {
+		if err := sp.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := sp.cur.Write(buf.Bytes())
+	sp.curSize += int64(n)
+	sp.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return sp.cur.Sync()
+}
+
+// rotate starts a new segment, the caller holds the lock.
+func (sp *spool) rotate() error {
+	if err := sp.seal(); err != nil {
+		return err
+	}
+
+	sp.seq++
+	f, err := os.OpenFile(filepath.Join(sp.dir, fmt.Sprintf("%020d%s", sp.seq, spoolSegmentExt)), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	sp.cur = f
+	sp.curSize = 0
+	return nil
+}
+
+// seal closes the current segment, the caller holds the lock.
+func (sp *spool) seal() error {
+	if sp.cur == nil {
+		return nil
+	}
+	err := sp.cur.Close()
+	sp.cur = nil
+	return err
+}
+
+// position returns the segment that was being replayed and how far.
+func (sp *spool) position() (string, int64) {
+	b, err := os.ReadFile(filepath.Join(sp.dir, spoolPositionFile))
+	if err != nil {
+		return "", 0
+	}
+	var seg string
+	var offset int64
+	if _, err := fmt.Sscanf(string(b), "%s %d", &seg, &offset); err != nil {
+		return "", 0
+	}
+	return seg, offset
+}
+
+func (sp *spool) savePosition(seg string, offset int64) error {
+	tmp := filepath.Join(sp.dir, spoolPositionFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%s %d\n", seg, offset)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(sp.dir, spoolPositionFile))
+}
+
+// replay hands the spooled records to fn, oldest first, and removes the
+// segments it is done with. It stops at the first error of fn and continues
+// from that record the next time. The position is saved every 100 records,
+// so records can be handed over twice when the server stops mid-replay.
+func (sp *spool) replay(fn func(spoolRecord) error) (int, error) {
+	sp.Lock()
+	// records spooled from now on go to a new segment
+	err := sp.seal()
+	sp.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	segs, err := sp.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	posSeg, posOffset := sp.position()
+	for _, seg := range segs {
+		sp.Lock()
+		current := sp.cur != nil && filepath.Base(sp.cur.Name()) == seg
+		sp.Unlock()
+		if current {
+			break
+		}
+
+		offset := int64(0)
+		if seg == posSeg {
+			offset = posOffset
+		}
+
+		n, err := sp.replaySegment(seg, offset, fn)
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		path := filepath.Join(sp.dir, seg)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return total, err
+		}
+		if err := os.Remove(path); err != nil {
+			return total, err
+		}
+		os.Remove(filepath.Join(sp.dir, spoolPositionFile))
+
+		sp.Lock()
+		sp.size -= fi.Size()
+		sp.Unlock()
+	}
+
+	return total, nil
+}
+
+func (sp *spool) replaySegment(seg string, offset int64, fn func(spoolRecord) error) (int, error) {
+	f, err := os.Open(filepath.Join(sp.dir, seg))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a line without a newline is a torn write
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		var rec spoolRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			log.Warn().Err(err).Msgf("skipping a broken record in spool segment %s", seg)
+		} else if err := fn(rec); err != nil {
+			if perr := sp.savePosition(seg, offset); perr != nil {
+				log.Error().Err(perr).Msg("can't save the spool replay position")
+			}
+			return n, err
+		}
+
+		offset += int64(len(line))
+		n++
+		if n%100 == 0 {
+			if err := sp.savePosition(seg, offset); err != nil {
+				return n, err
+			}
+		}
+	}
+}
+
+func dbAvailable() bool {
+	return atomic.LoadInt32(&dbDown) == 0
+}
+
+func setDBAvailable(available bool) {
+	var down int32
+	if !available {
+		down = 1
+	}
+	if atomic.SwapInt32(&dbDown, down) != down {
+		if available {
+			log.Info().Msg("the database is reachable again")
+		} else {
+			log.Warn().Msg("the database is unreachable, spooling calls")
+		}
+	}
+}
+
+func pingDB() error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
+
+// initSpool opens the spool when SPOOL_DIR is set and puts a spooledStore in
+// front of the store.
+func initSpool() error {
+	if viper.GetString("SPOOL_DIR") == "" {
+		return nil
+	}
+
+	sp, err := openSpool(viper.GetString("SPOOL_DIR"), viper.GetInt64("SPOOL_SEGMENT_BYTES"), viper.GetInt64("SPOOL_MAX_BYTES"))
+	if err != nil {
+		return err
+	}
+
+	callSpool = sp
+	store = spooledStore{Store: store}
+	return nil
+}
+
+// spooledStore spools the calls that can't be stored because the database
+// is unreachable.
+type spooledStore struct {
+	Store
+}
+
+func (ss spooledStore) RegisterCalls(calls []Call) error {
+	if dbAvailable() {
+		err := ss.Store.RegisterCalls(calls)
+		if err == nil || pingDB() == nil {
+			return err
+		}
+		setDBAvailable(false)
+	}
+
+	records := make([]spoolRecord, len(calls))
+	for i := range calls {
+		records[i].Call = &calls[i]
+	}
+	if err := callSpool.append(records); err != nil {
+		for _, c := range calls {
+			droppedCalls.add(c.Organisation, c.Repository, dropReasonSpoolFull, "", 1)
+		}
+		return err
+	}
+	return nil
+}
+
+// spoolMW spools the calls that come in while the database is unreachable
+// without looking them up in it, they are registered like any other call once
+// it is back. Only the checks that don't need the database are done, calls
+// are rate limited per client IP rather than per origin.
+func spoolMW(c *gin.Context) {
+	if callSpool == nil || dbAvailable() {
+		c.Next()
+		return
+	}
+
+	org := c.Param("organisation")
+	repo := c.Param("repository")
+	batch := strings.HasSuffix(c.FullPath(), "/batch")
+	limit := payloadLimits.MaxBytes
+	if batch {
+		limit = payloadLimits.MaxBatchBytes
+	}
+
+	body, err := readBody(c, limit)
+	if err != nil {
+		c.AbortWithStatusJSON(bodyErrorStatus(err), DefaultResp{Error: err.Error()})
+		return
+	}
+
+	n := 1
+	if batch {
+		items, err := splitBatch(body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, DefaultResp{Error: err.Error()})
+			return
+		}
+		if max := payloadLimits.MaxBatchItems; max > 0 && len(items) > max {
+			err := fmt.Sprintf("batch holds %d calls, the maximum is %d", len(items), max)
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, DefaultResp{Error: err})
+			return
+		}
+		if len(items) > n {
+			n = len(items)
+		}
+	} else if len(bytes.TrimSpace(body)) > 0 && !json.Valid(body) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, DefaultResp{Error: fmt.Sprintf("'%s' is invalid JSON", body)})
+		return
+	}
+
+	if ok, retryAfter := allowCallsFrom(spoolLimiters, org, repo, c.ClientIP(), n); !ok {
+		abortRateLimited(c, org, repo, n, retryAfter)
+		return
+	}
+
+	if checkRepoExistence && !githubRepoExists(org, repo) {
+		err := fmt.Sprintf("github repository doesn't seem to exist: %s/%s", org, repo)
+		c.AbortWithStatusJSON(http.StatusBadRequest, DefaultResp{Error: err})
+		return
+	}
+
+	sr := spooledRequest{
+		Organisation:    org,
+		Repository:      repo,
+		Event:           c.Param("event"),
+		Batch:           batch,
+		Body:            string(body),
+		ClientTimestamp: c.GetHeader(clientTimestampHeader),
+		ReceivedAt:      time.Now(),
+	}
+	if sr.Origin, err = spoolOrigin(c.ClientIP(), org, repo, sr.ReceivedAt); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, DefaultResp{Error: err.Error()})
+		return
+	}
+	if token := bearerToken(c); token != "" {
+		sr.TokenHash = hashToken(token)
+	}
+
+	if err := callSpool.append([]spoolRecord{{Request: &sr}}); err != nil {
+		droppedCalls.add(org, repo, dropReasonSpoolFull, "", int64(n))
+		c.Header("Retry-After", "60")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, DefaultResp{Error: err.Error()})
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusAccepted, SpooledResp{Message: "the database is unavailable, the call is registered once it is back"})
+}
+
+// replaySpooled registers a spooled record. Records that are refused, e.g.
+// for an invalid token or payload, are counted as dropped, and so are the
+// calls the database refuses. Errors are only returned when the record should
+// be replayed again later.
+func replaySpooled(rec spoolRecord) error {
+	var err error
+	var org, repo string
+	n := 1
+
+	// the database went away again
+	if !dbAvailable() {
+		return errDBUnavailable
+	}
+
+	// spooled calls are stored right away rather than queued, so that they are
+	// in the database by the time the spool is empty, see spoolPending
+	s := store
+	if qs, ok := s.(*queuedStore); ok {
+		s = qs.Store
+	}
+
+	switch {
+	case rec.Call != nil:
+		writeCalls(s, []Call{*rec.Call}, 1)
+		return nil
+	case rec.Request != nil:
+		org, repo = rec.Request.Organisation, rec.Request.Repository
+		n = rec.Request.calls()
+		err = replayRequest(s, *rec.Request)
+	default:
+		return nil
+	}
+
+	if err == nil {
+		return nil
+	}
+	if pingDB() != nil {
+		return err
+	}
+
+	reason := dropReasonInvalid
+	if errors.Is(err, errInvalidSpooledToken) {
+		reason = dropReasonUnauthorized
+	}
+	log.Warn().Err(err).Msgf("dropping %d spooled calls to %s/%s", n, org, repo)
+	droppedCalls.add(org, repo, reason, "", int64(n))
+	return nil
+}
+
+// calls returns the number of calls in the request.
+func (sr spooledRequest) calls() int {
+	if !sr.Batch {
+		return 1
+	}
+	// spoolMW only spools batches that can be split
+	items, err := splitBatch([]byte(sr.Body))
+	if err != nil || len(items) == 0 {
+		return 1
+	}
+	return len(items)
+}
+
+var errInvalidSpooledToken = errors.New("the call has no valid write token")
+
+// replayRequest registers a spooled request in s like registerCallHander or
+// registerBatchHandler would have. The calls of a batch that are invalid, or
+// that the database refuses, are counted as dropped, see writeCalls.
+func replayRequest(s Store, sr spooledRequest) error {
+	if checkRepoExistence && !githubRepoExists(sr.Organisation, sr.Repository) {
+		return fmt.Errorf("github repository doesn't seem to exist: %s/%s", sr.Organisation, sr.Repository)
+	}
+
+	required, err := tokenRequired(sr.Organisation, sr.Repository, scopeWrite)
+	if err != nil {
+		return err
+	}
+	if required {
+		ok, err := validRepoTokenHash(sr.Organisation, sr.Repository, sr.TokenHash, scopeWrite)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errInvalidSpooledToken
+		}
+	}
+
+	base := Call{Organisation: sr.Organisation, Repository: sr.Repository, Event: sr.Event, Origin: sr.Origin, Timestamp: sr.ReceivedAt}
+	if sr.ClientTimestamp != "" {
+		ts, err := parseClientTimestampHeader(sr.ClientTimestamp)
+		if err != nil {
+			return err
+		}
+		base.ClientTimestamp = &ts
+	}
+
+	if !sr.Batch {
+		base.Payload.RawMessage = json.RawMessage(sr.Body)
+		if _, err := prepareCall(&base); err != nil {
+			return err
+		}
+		writeCalls(s, []Call{base}, 1)
+		return nil
+	}
+
+	items, err := splitBatch([]byte(sr.Body))
+	if err != nil {
+		return err
+	}
+	_, calls := prepareBatch(items, base)
+	if rejected := len(items) - len(calls); rejected > 0 {
+		log.Warn().Msgf("dropping %d invalid spooled calls to %s/%s", rejected, sr.Organisation, sr.Repository)
+		droppedCalls.add(sr.Organisation, sr.Repository, dropReasonInvalid, "", int64(rejected))
+	}
+	writeCalls(s, calls, 1)
+	return nil
+}
+
+// spoolPending reports whether there are spooled calls that are not stored
+// yet. They were received in the past, so the jobs that move on once days are
+// over, rollups and retention, wait for them.
+func spoolPending() bool {
+	return callSpool != nil && !callSpool.empty()
+}
+
+// runSpoolReplayer checks every interval whether the database is reachable
+// and replays the spool once it is. When the server started without a
+// database, setUp prepares it first.
+func runSpoolReplayer(interval time.Duration, setUp func() error) {
+	for range time.Tick(interval) {
+		if err := pingDB(); err != nil {
+			setDBAvailable(false)
+			continue
+		}
+
+		if setUp != nil {
+			if err := setUp(); err != nil {
+				log.Error().Err(err).Msg("can't set up the database")
+				continue
+			}
+			setUp = nil
+			log.Info().Msg("the database is set up, leaving ingest-only mode")
+		}
+		setDBAvailable(true)
+
+		if callSpool.empty() {
+			continue
+		}
+		n, err := callSpool.replay(replaySpooled)
+		if n > 0 {
+			log.Info().Msgf("replayed %d spooled records", n)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("can't replay the spool")
+		}
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	storePostgres = "postgres"
+	storeSQLite   = "sqlite"
+	storeMemory   = "memory"
+)
+
+// Store keeps the calls and answers the queries on them. Everything else,
+// like claims, tokens and settings, lives in db.
+type Store interface {
+	RegisterCalls(calls []Call) error
+	ListCalls(fq FilterQuery) ([]Call, string, error)
+	CountCalls(fq FilterQuery) (int64, error)
+	CountByDate(fq FilterQuery) (DayCounts, error)
+	CountSeries(fq FilterQuery) (SeriesCounts, error)
+	CountByEvent(fq FilterQuery) (ValueCounts, error)
+	CountGroupBy(fq FilterQuery) (ValueCounts, error)
+	CountByDateGroupBy(fq FilterQuery) ([]ValueDayCounts, error)
+}
+
+var store Store = postgresStore{}
+
+// postgresStore queries the calls table in SQL and counts complete days
+// from the rollups. Only Postgres gets migrations, rollups, retention and
+// partitioning.
+type postgresStore struct{}
+
+func (postgresStore) RegisterCalls(calls []Call) error {
+	return storeCalls(calls)
+}
+
+// scanStore answers queries by filtering and counting the calls of a
+// repository in Go, for stores that can't query payloads like Postgres does.
+// Filters behave as in Postgres: values compare as ->> returns them.
+type scanStore struct {
+	scan func(fq FilterQuery) ([]Call, error)
+}
+
+// scannedCall is a call that matched a query, with the time it is counted at
+// in the time zone of the query.
+type scannedCall struct {
+	Call
+	at      time.Time
+	payload map[string]interface{}
+}
+
+// payloadText returns v like ->> does, false for null.
+func payloadText(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	default:
+		b, _ := json.Marshal(v)
+		return string(b), true
+	}
+}
+
+func matchesPayloadFilter(pl map[string]interface{}, pf PayloadFilter) bool {
+	v, ok := pl[pf.Key]
+
+	switch pf.Op {
+	case "eq", "ne":
+		text, notNull := payloadText(v)
+		eq := ok && notNull && text == pf.Value
+		return eq == (pf.Op == "eq")
+	}
+
+	// only compare numbers, other values never match
+	n, isNum := v.(json.Number)
+	if !isNum {
+		return false
+	}
+	x, err1 := n.Float64()
+	y, err2 := json.Number(pf.Value).Float64()
+	if err1 != nil || err2 != nil {
+		return false
+	}
+
+	switch pf.Op {
+	case "gt":
+		return x > y
+	case "gte":
+		return x >= y
+	case "lt":
+		return x < y
+	case "lte":
+		return x <= y
+	}
+	return false
+}
+
+// matching returns the calls that match fq, ordered by timestamp and id.
+func (s scanStore) matching(fq FilterQuery) ([]scannedCall, error) {
+	pfs, loc, err := checkFilterQuery(fq)
+	if err != nil {
+		return nil, err
+	}
+
+	calls, err := s.scan(fq)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []scannedCall
+	for _, c := range calls {
+		if fq.Event != "" && c.Event != fq.Event {
+			continue
+		}
+
+		at := c.Timestamp
+		if fq.TimeField == timeFieldClient && c.ClientTimestamp != nil {
+			at = *c.ClientTimestamp
+		}
+		if fq.FromDate != nil && at.Before(fq.FromDate.In(loc)) {
+			continue
+		}
+		if fq.ToDate != nil && !at.Before(fq.ToDate.In(loc)) {
+			continue
+		}
+
+		var pl map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(c.Payload.RawMessage))
+		dec.UseNumber()
+		if err := dec.Decode(&pl); err != nil {
+			return nil, err
+		}
+
+		if _, ok := pl[fq.Key]; fq.Key != "" && !ok {
+			continue
+		}
+		matched := true
+		for _, pf := range pfs {
+			if !matchesPayloadFilter(pl, pf) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			matches = append(matches, scannedCall{Call: c, at: at.In(loc), payload: pl})
+		}
+	}
+
+	return matches, nil
+}
+
+// counter counts calls, or their distinct origins, per group.
+type counter struct {
+	unique  bool
+	counts  map[string]int64
+	origins map[string]map[string]bool
+}
+
+func newCounter(fq FilterQuery) *counter {
+	return &counter{unique: fq.Unique, counts: map[string]int64{}, origins: map[string]map[string]bool{}}
+}
+
+func (cn *counter) add(group string, c scannedCall) {
+	if !cn.unique {
+		cn.counts[group]++
+		return
+	}
+
+	if cn.origins[group] == nil {
+		cn.origins[group] = map[string]bool{}
+	}
+	if !cn.origins[group][c.Origin] {
+		cn.origins[group][c.Origin] = true
+		cn.counts[group]++
+	}
+}
+
+// sortedValueCounts orders counts like the SQL queries do, by count
+// descending and value ascending.
+func sortedValueCounts(counts map[string]int64) ValueCounts {
+	vc := ValueCounts{}
+	for v, n := range counts {
+		vc = append(vc, ValueCount{Value: v, Count: n})
+	}
+	sort.Slice(vc, func(i, j int) bool {
+		if vc[i].Count != vc[j].Count {
+			return vc[i].Count > vc[j].Count
+		}
+		return vc[i].Value < vc[j].Value
+	})
+	return vc
+}
+
+func sortedDayCounts(counts map[string]int64) DayCounts {
+	dc := DayCounts{}
+	for d, n := range counts {
+		dc = append(dc, DayCount{Date: d, Count: n})
+	}
+	sort.Slice(dc, func(i, j int) bool { return dc[i].Date < dc[j].Date })
+	return dc
+}
+
+func (s scanStore) ListCalls(fq FilterQuery) ([]Call, string, error) {
+	calls := []Call{}
+
+	limit := fq.Limit
+	if limit <= 0 || limit > getCallsLimit {
+		limit = getCallsLimit
+	}
+
+	var after time.Time
+	var afterID uint
+	if fq.Cursor != "" {
+		var err error
+		if after, afterID, err = decodeCursor(fq.Cursor); err != nil {
+			return calls, "", err
+		}
+	}
+
+	matches, err := s.matching(fq)
+	if err != nil {
+		return calls, "", err
+	}
+
+	for _, m := range matches {
+		if fq.Cursor != "" && (m.Timestamp.Before(after) || m.Timestamp.Equal(after) && m.ID <= afterID) {
+			continue
+		}
+		if len(calls) == limit {
+			return calls, encodeCursor(calls[limit-1]), nil
+		}
+		calls = append(calls, m.Call)
+	}
+
+	return calls, "", nil
+}
+
+func (s scanStore) CountCalls(fq FilterQuery) (int64, error) {
+	matches, err := s.matching(fq)
+	if err != nil {
+		return 0, err
+	}
+
+	cn := newCounter(fq)
+	for _, m := range matches {
+		cn.add("", m)
+	}
+	return cn.counts[""], nil
+}
+
+func (s scanStore) CountByDate(fq FilterQuery) (DayCounts, error) {
+	matches, err := s.matching(fq)
+	if err != nil {
+		return DayCounts{}, err
+	}
+
+	cn := newCounter(fq)
+	for _, m := range matches {
+		cn.add(m.at.Format(YYYYMMDDLayout), m)
+	}
+	return sortedDayCounts(cn.counts), nil
+}
+
+func (s scanStore) CountSeries(fq FilterQuery) (SeriesCounts, error) {
+	interval, err := seriesInterval(fq)
+	if err != nil {
+		return SeriesCounts{}, err
+	}
+
+	matches, err := s.matching(fq)
+	if err != nil {
+		return SeriesCounts{}, err
+	}
+
+	var first time.Time
+	cn := newCounter(fq)
+	for _, m := range matches {
+		bucket := truncateToInterval(m.at, interval)
+		if first.IsZero() || bucket.Before(first) {
+			first = bucket
+		}
+		cn.add(bucket.Format(seriesBucketKey), m)
+	}
+
+	loc, err := filterLocation(fq)
+	if err != nil {
+		return SeriesCounts{}, err
+	}
+	return fillSeries(fq, interval, loc, first, cn.counts)
+}
+
+func (s scanStore) CountByEvent(fq FilterQuery) (ValueCounts, error) {
+	matches, err := s.matching(fq)
+	if err != nil {
+		return ValueCounts{}, err
+	}
+
+	cn := newCounter(fq)
+	for _, m := range matches {
+		cn.add(m.Event, m)
+	}
+	return sortedValueCounts(cn.counts), nil
+}
+
+// groupValue returns the value of the group by key of a call, empty for
+// null, and false when the call doesn't have the key.
+func groupValue(m scannedCall, key string) (string, bool) {
+	v, ok := m.payload[key]
+	if !ok {
+		return "", false
+	}
+	text, _ := payloadText(v)
+	return text, true
+}
+
+func (s scanStore) CountGroupBy(fq FilterQuery) (ValueCounts, error) {
+	matches, err := s.matching(fq)
+	if err != nil {
+		return ValueCounts{}, err
+	}
+
+	cn := newCounter(fq)
+	for _, m := range matches {
+		if v, ok := groupValue(m, fq.GroupBy); ok {
+			cn.add(v, m)
+		}
+	}
+	return sortedValueCounts(cn.counts), nil
+}
+
+func (s scanStore) CountByDateGroupBy(fq FilterQuery) ([]ValueDayCounts, error) {
+	vdc := []ValueDayCounts{}
+
+	matches, err := s.matching(fq)
+	if err != nil {
+		return vdc, err
+	}
+
+	perValue := map[string]*counter{}
+	for _, m := range matches {
+		v, ok := groupValue(m, fq.GroupBy)
+		if !ok {
+			continue
+		}
+		if perValue[v] == nil {
+			perValue[v] = newCounter(fq)
+		}
+		perValue[v].add(m.at.Format(YYYYMMDDLayout), m)
+	}
+
+	for v, cn := range perValue {
+		vdc = append(vdc, ValueDayCounts{Value: v, Data: sortedDayCounts(cn.counts)})
+	}
+	sort.Slice(vdc, func(i, j int) bool { return vdc[i].Value < vdc[j].Value })
+
+	return vdc, nil
+}
+
+// memoryStore keeps the calls in memory, for tests and trying things out.
+type memoryStore struct {
+	scanStore
+	sync.RWMutex
+	calls  map[string][]Call
+	nextID uint
+}
+
+func newMemoryStore() *memoryStore {
+	ms := &memoryStore{calls: map[string][]Call{}}
+	ms.scan = ms.repoCalls
+	return ms
+}
+
+func (ms *memoryStore) RegisterCalls(calls []Call) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	for _, c := range calls {
+		ms.nextID++
+		c.ID = ms.nextID
+
+		// calls usually arrive in order, but batches can hold older ones
+		key := c.Organisation + "/" + c.Repository
+		rc := ms.calls[key]
+		i := sort.Search(len(rc), func(i int) bool { return rc[i].Timestamp.After(c.Timestamp) })
+		rc = append(rc, Call{})
+		copy(rc[i+1:], rc[i:])
+		rc[i] = c
+		ms.calls[key] = rc
+	}
+
+	return nil
+}
+
+func (ms *memoryStore) repoCalls(fq FilterQuery) ([]Call, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return append([]Call(nil), ms.calls[fq.Organisation+"/"+fq.Repository]...), nil
+}
+
+// sqliteStore keeps the calls in the calls table of a SQLite db, for small
+// installations that want to run a single binary.
+type sqliteStore struct {
+	scanStore
+}
+
+func newSQLiteStore() sqliteStore {
+	ss := sqliteStore{}
+	ss.scan = ss.repoCalls
+	return ss
+}
+
+func (sqliteStore) RegisterCalls(calls []Call) error {
+	// SQLite compares times as text, which only sorts right within one offset
+	for i := range calls {
+		calls[i].Timestamp = calls[i].Timestamp.UTC()
+		if calls[i].ClientTimestamp != nil {
+			ts := calls[i].ClientTimestamp.UTC()
+			calls[i].ClientTimestamp = &ts
+		}
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.CreateInBatches(&calls, 500).Error
+	})
+}
+
+// repoQuery selects the calls of a repository that match fq on their
+// columns, payload filters are left to the scan.
+func (sqliteStore) repoQuery(fq FilterQuery) (*gorm.DB, error) {
+	gq := db.Model(&Call{}).Where("organisation = ? AND repository = ?", fq.Organisation, fq.Repository)
+	if fq.Event != "" {
+		gq = gq.Where("event = ?", fq.Event)
+	}
+
+	if fq.TimeField != timeFieldClient {
+		loc, err := filterLocation(fq)
+		if err != nil {
+			return nil, err
+		}
+		if fq.FromDate != nil {
+			gq = gq.Where("timestamp >= ?", fq.FromDate.In(loc).UTC())
+		}
+		if fq.ToDate != nil {
+			gq = gq.Where("timestamp < ?", fq.ToDate.In(loc).UTC())
+		}
+	}
+
+	return gq, nil
+}
+
+func (ss sqliteStore) repoCalls(fq FilterQuery) ([]Call, error) {
+	var calls []Call
+
+	gq, err := ss.repoQuery(fq)
+	if err != nil {
+		return calls, err
+	}
+
+	err = gq.Order("timestamp asc, id asc").Find(&calls).Error
+	return calls, err
+}
+
+// columnsOnly reports whether fq only filters on columns and counts by the
+// server time, so that SQLite can count the calls without scanning them.
+func columnsOnly(fq FilterQuery) bool {
+	return fq.Key == "" && len(fq.Where) == 0 && fq.TimeField != timeFieldClient
+}
+
+func (ss sqliteStore) CountCalls(fq FilterQuery) (int64, error) {
+	var count int64
+
+	if !columnsOnly(fq) {
+		return ss.scanStore.CountCalls(fq)
+	}
+	if _, _, err := checkFilterQuery(fq); err != nil {
+		return count, err
+	}
+
+	gq, err := ss.repoQuery(fq)
+	if err != nil {
+		return count, err
+	}
+
+	err = gq.Select(countExpr(fq)).Scan(&count).Error
+	return count, err
+}
+
+func (ss sqliteStore) CountByDate(fq FilterQuery) (DayCounts, error) {
+	dc := DayCounts{}
+
+	if !columnsOnly(fq) {
+		return ss.scanStore.CountByDate(fq)
+	}
+	_, loc, err := checkFilterQuery(fq)
+	if err != nil {
+		return dc, err
+	}
+	// timestamps are stored in UTC, SQLite doesn't know other time zones
+	if loc != time.UTC {
+		return ss.scanStore.CountByDate(fq)
+	}
+
+	gq, err := ss.repoQuery(fq)
+	if err != nil {
+		return dc, err
+	}
+
+	err = gq.Select("date(timestamp) as date, " + countExpr(fq) + " as count").
+		Group("date").
+		Order("date asc").
+		Find(&dc).Error
+	return dc, err
+}
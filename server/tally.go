@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type tallyKey struct {
+	organisation string
+	repository   string
+	day          string
+	label        string
+	detail       string
+}
+
+// dailyTally counts occurrences per repository and day in memory so that a
+// flood of them doesn't turn into a flood of writes. flush hands the counts
+// to persist, e.g. to upsert them into a table.
+type dailyTally struct {
+	sync.Mutex
+	counts  map[tallyKey]int64
+	persist func(counts map[tallyKey]int64) error
+}
+
+var tallies []*dailyTally
+
+func newDailyTally(persist func(counts map[tallyKey]int64) error) *dailyTally {
+	t := &dailyTally{counts: map[tallyKey]int64{}, persist: persist}
+	tallies = append(tallies, t)
+	return t
+}
+
+func (t *dailyTally) add(org string, repo string, label string, detail string, n int64) {
+	day := time.Now().In(serverLocation).Format(YYYYMMDDLayout)
+
+	t.Lock()
+	defer t.Unlock()
+	t.counts[tallyKey{org, repo, day, label, detail}] += n
+}
+
+func (t *dailyTally) flush() error {
+	t.Lock()
+	counts := t.counts
+	t.counts = map[tallyKey]int64{}
+	t.Unlock()
+
+	if len(counts) == 0 {
+		return nil
+	}
+
+	err := t.persist(counts)
+	if err != nil {
+		// put them back so they are retried on the next flush
+		t.Lock()
+		for k, n := range counts {
+			t.counts[k] += n
+		}
+		t.Unlock()
+	}
+
+	return err
+}
+
+func flushTallies() {
+	for _, t := range tallies {
+		if err := t.flush(); err != nil {
+			log.Error().Err(err).Msg("can't persist tally")
+		}
+	}
+}
+
+// runTallyFlusher periodically persists all tallies.
+func runTallyFlusher(interval time.Duration) {
+	for range time.Tick(interval) {
+		flushTallies()
+	}
+}
@@ -1,36 +1,87 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // the runtime image ships without a zoneinfo database
 
+	"github.com/glebarez/sqlite"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
-	"gorm.io/datatypes"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
+// InitDBConn opens the database of the STORE backend. Postgres is migrated,
+// SQLite and memory stores get their tables created from the models.
 func InitDBConn() error {
+	switch viper.GetString("STORE") {
+	case storePostgres:
+		store = postgresStore{}
+		return initPostgres()
+	case storeSQLite:
+		store = newSQLiteStore()
+		return initSQLite(viper.GetString("SQLITE_PATH") + "?_pragma=busy_timeout(5000)")
+	case storeMemory:
+		store = newMemoryStore()
+		return initSQLite(":memory:")
+	default:
+		return fmt.Errorf("unknown store '%s', expected one of %s, %s or %s",
+			viper.GetString("STORE"), storePostgres, storeSQLite, storeMemory)
+	}
+}
+
+func initSQLite(dsn string) error {
+	var err error
+
+	db, err = gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Info)})
+	if err != nil {
+		return err
+	}
+
+	// a single connection keeps writers from running into locks, and an in
+	// memory database alive
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	sqlDB.SetMaxOpenConns(1)
+	sqlDB.SetMaxIdleConns(1)
+
+	return db.AutoMigrate(storeModels()...)
+}
+
+func initPostgres() error {
 	var err error
 	var dsn string
 
 	if viper.GetString("PG_SOCKET_DIR") == "" {
-		dsn = fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=disable TimeZone=Europe/Brussels",
+		dsn = fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=disable TimeZone=%s",
 			viper.GetString("PG_HOST"),
 			viper.GetString("PG_USER"),
 			viper.GetString("PG_PASS"),
 			viper.GetString("PG_DATABASE"),
-			viper.GetInt("PG_PORT"))
+			viper.GetInt("PG_PORT"),
+			viper.GetString("TIMEZONE"))
 	} else {
-		dsn = fmt.Sprintf("host=%s/%s user=%s password=%s dbname=%s sslmode=disable TimeZone=Europe/Brussels",
+		dsn = fmt.Sprintf("host=%s/%s user=%s password=%s dbname=%s sslmode=disable TimeZone=%s",
 			viper.GetString("PG_SOCKET_DIR"),
 			viper.GetString("PG_INSTANCE_CONNECTION_NAME"),
 			viper.GetString("PG_USER"),
 			viper.GetString("PG_PASS"),
-			viper.GetString("PG_DATABASE"))
+			viper.GetString("PG_DATABASE"),
+			viper.GetString("TIMEZONE"))
 	}
 
 	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Info)})
@@ -38,8 +89,31 @@ func InitDBConn() error {
 		return err
 	}
 
-	if err := autoMigrate(); err != nil {
-		return err
+	return setUpPostgres()
+}
+
+// setUpPostgres migrates the database and creates the partitions of calls,
+// as configured.
+func setUpPostgres() error {
+	if viper.GetBool("MIGRATE_ON_START") {
+		done, err := migrateUp(0)
+		if err != nil {
+			return err
+		}
+		for _, ms := range done {
+			log.Info().Msgf("applied migration %d %s", ms.version, ms.name)
+		}
+	}
+
+	if viper.GetBool("PARTITION_CALLS") {
+		if viper.GetBool("MIGRATE_ON_START") {
+			if err := partitionCalls(time.Now()); err != nil {
+				return err
+			}
+		}
+		if err := createPartitions(time.Now()); err != nil {
+			log.Error().Err(err).Msg("can't create partitions")
+		}
 	}
 
 	return nil
@@ -69,66 +143,471 @@ func InitConfig() {
 	viper.MergeConfigMap(sec.AllSettings())
 
 	viper.SetDefault("PORT", 8888)
+	viper.SetDefault("TIMEZONE", "Europe/Brussels")
+	viper.SetDefault("ORIGIN_SALT_ROTATION", "24h")
+	viper.SetDefault("GITHUB_API_URL", "https://api.github.com")
+	viper.SetDefault("RATE_LIMIT_ORIGIN_RPS", 1)
+	viper.SetDefault("RATE_LIMIT_ORIGIN_BURST", 60)
+	viper.SetDefault("RATE_LIMIT_REPO_RPS", 100)
+	viper.SetDefault("RATE_LIMIT_REPO_BURST", 1000)
+	viper.SetDefault("CLIENT_TS_MAX_PAST", "720h")
+	viper.SetDefault("CLIENT_TS_MAX_FUTURE", "5m")
+	viper.SetDefault("CLIENT_TS_SKEW", clientTsClamp)
+	viper.SetDefault("STORE", storePostgres)
+	viper.SetDefault("SQLITE_PATH", "phonehome.db")
+	viper.SetDefault("MIGRATE_ON_START", true)
+	viper.SetDefault("PARTITION_CALLS", false)
+	viper.SetDefault("PARTITION_PREMAKE_MONTHS", 3)
+	viper.SetDefault("PARTITION_DETACH_EXPIRED", false)
+	viper.SetDefault("CALL_ATTRIBUTES", false)
+	viper.SetDefault("SHUTDOWN_TIMEOUT", "30s")
+	viper.SetDefault("SPOOL_DIR", "")
+	viper.SetDefault("SPOOL_SEGMENT_BYTES", 16<<20)
+	viper.SetDefault("SPOOL_MAX_BYTES", 1<<30)
+	viper.SetDefault("SPOOL_REPLAY_INTERVAL", "10s")
+	viper.SetDefault("INGEST_ASYNC", false)
+	viper.SetDefault("INGEST_QUEUE_SIZE", 100000)
+	viper.SetDefault("INGEST_BACKPRESSURE", ingestBlock)
+	viper.SetDefault("INGEST_FLUSH_INTERVAL", "200ms")
+	viper.SetDefault("INGEST_FLUSH_ROWS", 1000)
+	viper.SetDefault("INGEST_WRITE_ATTEMPTS", 5)
+	viper.SetDefault("ANALYTICS_SINK", "")
+	viper.SetDefault("CLICKHOUSE_URL", "http://localhost:8123")
+	viper.SetDefault("CLICKHOUSE_DATABASE", "default")
+	viper.SetDefault("CLICKHOUSE_USER", "default")
+	viper.SetDefault("CLICKHOUSE_PASSWORD", "")
+	viper.SetDefault("CLICKHOUSE_QUERIES", false)
+	viper.SetDefault("CLICKHOUSE_FLUSH_INTERVAL", "5s")
+	viper.SetDefault("CLICKHOUSE_FLUSH_ROWS", 10000)
+	viper.SetDefault("CLICKHOUSE_MAX_BUFFERED", 1000000)
+	viper.SetDefault("RETENTION_DAYS", 0)
+	viper.SetDefault("RETENTION_ROLLUP", true)
+	viper.SetDefault("RETENTION_BATCH_SIZE", 10000)
+	setPayloadLimitDefaults()
+	viper.SetDefault("PII_DETECTORS", defaultDetectors)
 
 	checkRepoExistence = viper.GetBool("CHECK_REPO_EXISTENCE")
+	useCallAttributes = viper.GetBool("CALL_ATTRIBUTES")
+	githubAPIURL = strings.TrimSuffix(viper.GetString("GITHUB_API_URL"), "/")
+
+	originSecret = viper.GetString("ORIGIN_SECRET")
+	if originSecret == "" {
+		log.Warn().Msg("ORIGIN_SECRET is not set, origins are only protected by the rotating salt")
+	}
+
+	originSaltRotation = viper.GetDuration("ORIGIN_SALT_ROTATION")
+	if originSaltRotation <= 0 {
+		log.Warn().Msgf("invalid ORIGIN_SALT_ROTATION '%s', falling back to 24h", viper.GetString("ORIGIN_SALT_ROTATION"))
+		originSaltRotation = 24 * time.Hour
+	}
+
+	loc, err := time.LoadLocation(viper.GetString("TIMEZONE"))
+	if err != nil {
+		log.Warn().Msgf("unknown TIMEZONE '%s', falling back to UTC", viper.GetString("TIMEZONE"))
+		loc = time.UTC
+	}
+	serverLocation = loc
+
+	loadRateLimits()
+	loadPayloadLimits()
+	loadScrubRules()
 }
 
-func autoMigrate() error {
-	if err := db.AutoMigrate(&Call{}); err != nil {
-		return err
+// checkFilterQuery validates fq and returns its payload filters and time zone.
+func checkFilterQuery(fq FilterQuery) ([]PayloadFilter, *time.Location, error) {
+	if fq.Organisation == "" || fq.Repository == "" {
+		return nil, nil, errors.New("please specify organisation and repository")
 	}
-	return nil
+
+	var pfs []PayloadFilter
+	for _, w := range fq.Where {
+		pf, err := parsePayloadFilter(w)
+		if err != nil {
+			return nil, nil, err
+		}
+		pfs = append(pfs, pf)
+	}
+
+	loc, err := filterLocation(fq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fq.TimeField != "" && fq.TimeField != timeFieldServer && fq.TimeField != timeFieldClient {
+		return nil, nil, fmt.Errorf("unknown time '%s', expected server or client", fq.TimeField)
+	}
+
+	return pfs, loc, nil
 }
 
 func callsQueryBuilder(fq FilterQuery) (*gorm.DB, error) {
-	var gq *gorm.DB
+	pfs, loc, err := checkFilterQuery(fq)
+	if err != nil {
+		return nil, err
+	}
 
-	gq = db
+	gq := db.Where("organisation = ? AND repository = ?", fq.Organisation, fq.Repository)
 
-	if fq.Organisation == "" || fq.Repository == "" {
-		return nil, errors.New("please specify organisation and repository")
+	if fq.Event != "" {
+		gq = gq.Where("event = ?", fq.Event)
 	}
-	gq = gq.Where("organisation = ? AND repository = ?", fq.Organisation, fq.Repository)
 
 	if fq.Key != "" {
-		gq = gq.Where(datatypes.JSONQuery("payload").HasKey(fq.Key))
+		gq = hasKeyFilter(gq, fq.Key)
+	}
+
+	for _, pf := range pfs {
+		num, _ := strconv.ParseFloat(pf.Value, 64)
+		gq = payloadFilter(gq, pf, num)
 	}
 
 	if fq.FromDate != nil {
-		gq = gq.Where("timestamp >= ?", fq.FromDate)
+		gq = gq.Where(timeColumn(fq)+" >= ?", fq.FromDate.In(loc))
 	}
 
 	if fq.ToDate != nil {
-		gq = gq.Where("timestamp < ?", fq.ToDate)
+		gq = gq.Where(timeColumn(fq)+" < ?", fq.ToDate.In(loc))
 	}
 
 	return gq, nil
 }
 
 func githubRepoExists(user string, repo string) bool {
-	resp, err := http.Get(fmt.Sprintf("https://api.github.com/repos/%s/%s", user, repo))
+	resp, err := http.Get(fmt.Sprintf("%s/repos/%s/%s", githubAPIURL, user, repo))
 	if err != nil {
 		return false
 	}
+	defer resp.Body.Close()
 
 	return resp.StatusCode == 200
 }
 
-func payloadStripper(pl CallPayload) (CallPayload, bool) {
-	var stripped bool
+// githubFileContent fetches a file from the default branch of a repository.
+func githubFileContent(user string, repo string, path string) (string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/repos/%s/%s/contents/%s", githubAPIURL, user, repo, path), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3.raw")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("can't fetch %s from %s/%s: %s", path, user, repo, resp.Status)
+	}
+
+	// the file only holds a token, don't read more than needed
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return string(b), err
+}
+
+// payloadStripper removes the values of pl that are not allowed: anything but
+// strings, numbers, booleans, null and arrays of up to MaxArrayLength of those
+// scalars. It returns which keys were removed and why, sorted by key.
+func payloadStripper(pl CallPayload) (CallPayload, []KeyIssue) {
+	stripped := []KeyIssue{}
 	for k, v := range pl {
-		switch v.(type) {
-		case string:
-			break
-		case int:
-			break
-		case float64:
-			break
+		var reason string
+		switch v := v.(type) {
+		case string, float64, bool, nil:
+		case []interface{}:
+			if payloadLimits.MaxArrayLength > 0 && len(v) > payloadLimits.MaxArrayLength {
+				reason = stripArrayTooLong
+				break
+			}
+			for _, item := range v {
+				if !isScalar(item) {
+					reason = stripArrayNotScalar
+				}
+			}
+		case map[string]interface{}:
+			reason = stripNestedObject
 		default:
+			reason = stripUnsupported
+		}
+
+		if reason != "" {
 			delete(pl, k)
-			stripped = true
+			stripped = append(stripped, KeyIssue{k, reason})
 		}
 	}
 
+	sort.Slice(stripped, func(i, j int) bool { return stripped[i].Key < stripped[j].Key })
 	return pl, stripped
 }
+
+// encodeCursor returns an opaque pagination cursor pointing right after c.
+func encodeCursor(c Call) string {
+	raw := fmt.Sprintf("%d:%d", c.Timestamp.UnixNano(), c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (time.Time, uint, error) {
+	var nsec int64
+	var id uint
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+
+	if _, err := fmt.Sscanf(string(raw), "%d:%d", &nsec, &id); err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor '%s'", cursor)
+	}
+
+	return time.Unix(0, nsec), id, nil
+}
+
+// serverLocation is the TIMEZONE of the server, resolved once by InitConfig
+// as it is needed for every call that is tallied.
+var serverLocation = time.UTC
+
+// filterLocation returns the time zone dates are interpreted and grouped in,
+// falling back to the server's default time zone.
+func filterLocation(fq FilterQuery) (*time.Location, error) {
+	tz := fq.TZ
+	if tz == "" {
+		return serverLocation, nil
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone '%s'", tz)
+	}
+
+	return loc, nil
+}
+
+// countExpr is the aggregate counted by the count endpoints, either all
+// calls or distinct origins.
+func countExpr(fq FilterQuery) string {
+	if fq.Unique {
+		return "count(distinct origin)"
+	}
+	return "count(*)"
+}
+
+// parseClientTimestampHeader parses the X-Phonehome-Timestamp header, see
+// parseClientTimestamp.
+func parseClientTimestampHeader(h string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(h, 64); err == nil {
+		return parseClientTimestamp(f)
+	}
+	return parseClientTimestamp(h)
+}
+
+// checkClientTimestamp applies the allowed clock skew, CLIENT_TS_MAX_PAST
+// before and CLIENT_TS_MAX_FUTURE after the time the call was received.
+// Timestamps outside of the window are clamped to it or rejected,
+// depending on CLIENT_TS_SKEW.
+func checkClientTimestamp(ts time.Time, received time.Time) (time.Time, error) {
+	earliest := received.Add(-viper.GetDuration("CLIENT_TS_MAX_PAST"))
+	latest := received.Add(viper.GetDuration("CLIENT_TS_MAX_FUTURE"))
+
+	if !ts.Before(earliest) && !ts.After(latest) {
+		return ts, nil
+	}
+
+	if viper.GetString("CLIENT_TS_SKEW") == clientTsReject {
+		return ts, fmt.Errorf("timestamp %s is outside of the allowed window from %s to %s",
+			ts.Format(time.RFC3339), earliest.Format(time.RFC3339), latest.Format(time.RFC3339))
+	}
+
+	if ts.Before(earliest) {
+		return earliest, nil
+	}
+	return latest, nil
+}
+
+// timeColumn is the time the read endpoints filter and bucket on, either
+// the receive time or the client time falling back to the receive time.
+func timeColumn(fq FilterQuery) string {
+	if fq.TimeField == timeFieldClient {
+		return "coalesce(client_timestamp, timestamp)"
+	}
+	return "timestamp"
+}
+
+// parseClientTimestamp parses a timestamp passed by a client, either an RFC 3339
+// string or a number of (fractional) unix seconds.
+func parseClientTimestamp(v interface{}) (time.Time, error) {
+	switch ts := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp '%s', expected RFC 3339 or unix seconds", ts)
+		}
+		return t, nil
+	case float64:
+		sec, frac := math.Modf(ts)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp '%v', expected RFC 3339 or unix seconds", v)
+	}
+}
+
+var eventNameRe = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+var payloadFilterOps = map[string]string{"eq": "=", "ne": "<>", "gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+
+// parsePayloadFilter parses a `key:op:value` filter, e.g. `version:eq:1.4.0`.
+// The value may contain colons, comparison operators require a number.
+func parsePayloadFilter(w string) (PayloadFilter, error) {
+	parts := strings.SplitN(w, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return PayloadFilter{}, fmt.Errorf("invalid where filter '%s', expected key:op:value", w)
+	}
+
+	pf := PayloadFilter{Key: parts[0], Op: parts[1], Value: parts[2]}
+	if _, ok := payloadFilterOps[pf.Op]; !ok {
+		return pf, fmt.Errorf("invalid where filter '%s', unknown operator '%s'", w, pf.Op)
+	}
+
+	if pf.Op != "eq" && pf.Op != "ne" {
+		if _, err := strconv.ParseFloat(pf.Value, 64); err != nil {
+			return pf, fmt.Errorf("invalid where filter '%s', '%s' needs a number", w, pf.Op)
+		}
+	}
+
+	return pf, nil
+}
+
+var seriesIntervals = map[string]bool{"hour": true, "day": true, "week": true, "month": true}
+
+// seriesInterval returns the interval of the buckets of fq, day by default.
+func seriesInterval(fq FilterQuery) (string, error) {
+	interval := fq.Interval
+	if interval == "" {
+		interval = "day"
+	}
+	if !seriesIntervals[interval] {
+		return interval, fmt.Errorf("unknown interval '%s', expected one of hour, day, week or month", interval)
+	}
+	return interval, nil
+}
+
+// fillSeries turns counts keyed by bucket into a series that runs from
+// from_date (or the first bucket) to to_date (or now), filling the buckets
+// without calls with a zero count.
+func fillSeries(fq FilterQuery, interval string, loc *time.Location, first time.Time, counts map[string]int64) (SeriesCounts, error) {
+	sc := SeriesCounts{}
+
+	var start, end time.Time
+	switch {
+	case fq.FromDate != nil:
+		start = fq.FromDate.In(loc)
+	case !first.IsZero():
+		start = first
+	default:
+		return sc, nil
+	}
+
+	if fq.ToDate != nil {
+		end = fq.ToDate.In(loc)
+	} else {
+		end = time.Now().In(loc)
+	}
+
+	for t := truncateToInterval(start, interval); t.Before(end); t = nextInterval(t, interval) {
+		if len(sc) == maxSeriesBuckets {
+			return SeriesCounts{}, fmt.Errorf("more than %d buckets requested, narrow the date range or use a larger interval", maxSeriesBuckets)
+		}
+		sc = append(sc, SeriesCount{Bucket: t.Format(time.RFC3339), Count: counts[t.Format(seriesBucketKey)]})
+	}
+
+	return sc, nil
+}
+
+// truncateToInterval returns the start of the interval bucket t falls in,
+// in t's location. Weeks start on monday, like postgres' date_trunc.
+func truncateToInterval(t time.Time, interval string) time.Time {
+	switch interval {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+}
+
+func nextInterval(t time.Time, interval string) time.Time {
+	switch interval {
+	case "hour":
+		return t.Add(time.Hour)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "month":
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// repoCache caches per repository settings that are needed for every call,
+// including the fact that a repository has none, so that ingestion doesn't
+// need extra queries. Changes take up to ttl to reach other server instances.
+type repoCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]repoCacheEntry
+}
+
+type repoCacheEntry struct {
+	value   interface{}
+	fetched time.Time
+}
+
+func newRepoCache(ttl time.Duration) *repoCache {
+	return &repoCache{ttl: ttl, entries: map[string]repoCacheEntry{}}
+}
+
+// get returns the cached value for a repository, calling load when it is
+// missing or expired. Errors are not cached.
+func (rc *repoCache) get(org string, repo string, load func() (interface{}, error)) (interface{}, error) {
+	key := org + "/" + repo
+
+	rc.Lock()
+	e, ok := rc.entries[key]
+	rc.Unlock()
+	if ok && time.Since(e.fetched) < rc.ttl {
+		return e.value, nil
+	}
+
+	v, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	rc.Lock()
+	rc.entries[key] = repoCacheEntry{v, time.Now()}
+	rc.Unlock()
+
+	return v, nil
+}
+
+// cleanup removes the expired entries, so that caching every repository a
+// call was made to doesn't grow without bound.
+func (rc *repoCache) cleanup() {
+	rc.Lock()
+	defer rc.Unlock()
+
+	for k, e := range rc.entries {
+		if time.Since(e.fetched) >= rc.ttl {
+			delete(rc.entries, k)
+		}
+	}
+}
+
+func (rc *repoCache) forget(org string, repo string) {
+	rc.Lock()
+	defer rc.Unlock()
+	delete(rc.entries, org+"/"+repo)
+}